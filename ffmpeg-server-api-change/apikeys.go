@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The API keys are kept in here, apart from the jobs, so `keys` can change them while the server runs
+const API_KEY_DB = "apikeys.db"
+
+// Every key starts with this, so a leaked one is easy to recognize
+const API_KEY_PREFIX = "mhk_"
+
+// The limits of a new key unless others are asked for. 0 is no limit.
+const DEFAULT_RATE_LIMIT = 60   // Render submissions per minute
+const DEFAULT_DAILY_QUOTA = 100 // Renders per day, in UTC
+
+var apiKeysBucket = []byte("apikeys")
+
+var ErrKeyNotFound = errors.New("API key not found")
+
+// A client of the API. Only the hash of the key is kept, the key itself is shown once when it's issued.
+type APIKey struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"hash"`
+	RateLimit  int        `json:"rateLimit"`  // Render submissions per minute, 0 is no limit
+	DailyQuota int        `json:"dailyQuota"` // Renders per day, 0 is no limit
+	CreatedAt  time.Time  `json:"createdAt"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// KeyStore keeps the API keys in a bbolt database, one JSON record per key keyed by its hash.
+// The server reads them again whenever the file changes, so issued and revoked keys count right away.
+type KeyStore struct {
+	path string
+
+	mu      sync.Mutex
+	keys    map[string]APIKey // Per hash
+	modTime time.Time         // Of the file when the keys were read
+}
+
+// Open the key database at path, it's made if it doesn't exist
+func OpenKeyStore(path string) (*KeyStore, error) {
+	var s = &KeyStore{path: path}
+
+	err := s.update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(apiKeysBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, s.reload()
+}
+
+// The database is only open while it's used, the server and `keys` take turns
+func (s *KeyStore) open(readOnly bool) (*bolt.DB, error) {
+	return bolt.Open(s.path, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+}
+
+func (s *KeyStore) update(fn func(tx *bolt.Tx) error) error {
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(fn)
+}
+
+func (s *KeyStore) List() ([]APIKey, error) {
+	db, err := s.open(true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var keys []APIKey
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiKeysBucket).ForEach(func(hash, data []byte) error {
+			var key APIKey
+			if err := json.Unmarshal(data, &key); err != nil {
+				return err
+			}
+
+			keys = append(keys, key)
+			return nil
+		})
+	})
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys, err
+}
+
+// Make a new key with the limits. The key is returned only this once.
+func (s *KeyStore) Issue(name string, rateLimit int, dailyQuota int) (string, APIKey, error) {
+	var secret = make([]byte, 32)
+	var id = make([]byte, 6)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return "", APIKey{}, err
+	}
+
+	var token = API_KEY_PREFIX + base64.RawURLEncoding.EncodeToString(secret)
+	var key = APIKey{
+		Id:         hex.EncodeToString(id),
+		Name:       name,
+		Hash:       hashKey(token),
+		RateLimit:  rateLimit,
+		DailyQuota: dailyQuota,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	err = s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiKeysBucket).Put([]byte(key.Hash), data)
+	})
+
+	return token, key, err
+}
+
+// Mark the key with the id revoked. It's kept, so the list still shows who had it.
+func (s *KeyStore) Revoke(id string) (APIKey, error) {
+	var revoked APIKey
+
+	err := s.update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket(apiKeysBucket)
+
+		var found []byte
+		bucket.ForEach(func(hash, data []byte) error {
+			var key APIKey
+			if json.Unmarshal(data, &key) == nil && key.Id == id {
+				found = hash
+				revoked = key
+			}
+			return nil
+		})
+
+		if found == nil {
+			return ErrKeyNotFound
+		}
+
+		if revoked.RevokedAt == nil {
+			var now = time.Now().UTC()
+			revoked.RevokedAt = &now
+		}
+
+		data, err := json.Marshal(revoked)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(found, data)
+	})
+
+	return revoked, err
+}
+
+// The key that isn't revoked for the token sent by a client
+func (s *KeyStore) Lookup(token string) (APIKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Read the keys again if `keys` changed them, the old ones are used if that fails
+	if info, err := os.Stat(s.path); err == nil && !info.ModTime().Equal(s.modTime) {
+		if err := s.load(); err != nil {
+			slog.Error("reading API keys", "error", err)
+		}
+	}
+
+	key, ok := s.keys[hashKey(token)]
+	if !ok || key.RevokedAt != nil {
+		return APIKey{}, false
+	}
+
+	return key, true
+}
+
+func (s *KeyStore) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.load()
+}
+
+// Must be called with the lock held
+func (s *KeyStore) load() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	list, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	s.keys = make(map[string]APIKey, len(list))
+	for _, key := range list {
+		s.keys[key.Hash] = key
+	}
+	s.modTime = info.ModTime()
+
+	return nil
+}
+
+// Keys are long and random, so they can't be guessed back from a plain hash, and it's quick enough for every request
+func hashKey(token string) string {
+	var sum = sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue, revoke and list API keys: keys issue -name NAME [-rate N] [-quota N], keys revoke ID or keys list.
+// The config flags are taken too, for where the key database is.
+func runKeysCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: keys issue -name NAME [-rate N] [-quota N] | keys revoke ID | keys list")
+	}
+
+	var action = args[0]
+	var fs = flag.NewFlagSet("keys "+action, flag.ExitOnError)
+
+	var name *string
+	var rateLimit, dailyQuota *int
+	if action == "issue" {
+		name = fs.String("name", "", "who the key is for")
+		rateLimit = fs.Int("rate", DEFAULT_RATE_LIMIT, "render submissions per minute, 0 is no limit")
+		dailyQuota = fs.Int("quota", DEFAULT_DAILY_QUOTA, "renders per day, 0 is no limit")
+	}
+
+	// Only the key database is used, so the rest of the config needn't be valid, only readable
+	cfg, err := LoadConfig(fs, args[1:])
+	if cfg == nil {
+		return fmt.Errorf("invalid config:\n%w", err)
+	}
+	if cfg.KeyDB == "" {
+		return errors.New("keyDb must be set")
+	}
+
+	keys, err := OpenKeyStore(cfg.KeyDB)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "issue":
+		if *name == "" {
+			return errors.New("-name must be set")
+		}
+		if *rateLimit < 0 || *dailyQuota < 0 {
+			return errors.New("-rate and -quota must not be negative")
+		}
+
+		token, key, err := keys.Issue(*name, *rateLimit, *dailyQuota)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Issued key %s for %s, it is not shown again:\n\n%s\n", key.Id, key.Name, token)
+
+	case "revoke":
+		if fs.NArg() != 1 {
+			return errors.New("usage: keys revoke ID")
+		}
+
+		key, err := keys.Revoke(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Revoked key %s for %s\n", key.Id, key.Name)
+
+	case "list":
+		list, err := keys.List()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%-12s  %-20s  %8s  %8s  %-10s  %s\n", "id", "name", "per min", "per day", "created", "revoked")
+		for _, key := range list {
+			var revoked = "-"
+			if key.RevokedAt != nil {
+				revoked = key.RevokedAt.Format(time.DateOnly)
+			}
+			fmt.Printf("%-12s  %-20s  %8s  %8s  %-10s  %s\n", key.Id, key.Name, formatLimit(key.RateLimit), formatLimit(key.DailyQuota), key.CreatedAt.Format(time.DateOnly), revoked)
+		}
+
+	default:
+		return fmt.Errorf("unknown keys command %q, must be issue, revoke or list", action)
+	}
+
+	return nil
+}
+
+func formatLimit(n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprint(n)
+}
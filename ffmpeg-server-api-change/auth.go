@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the token in the eventsUrl of a job can be used to follow its progress
+const EVENTS_TOKEN_TTL = time.Hour
+
+// Auth checks the API key of every request that can render or see jobs, and holds every key to its limits.
+// The render submissions of a key are limited with a token bucket that holds a minute of them, reads aren't,
+// so a client can poll a long render. Its renders are counted per UTC day and kept in the job database,
+// so a restart doesn't reset them.
+type Auth struct {
+	required bool // Without it anyone may render, with no limits
+	keys     *KeyStore
+	store    *JobStore
+	secret   []byte // Signs the events tokens, made on every start so a restart invalidates them
+
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter // Per key id
+	day      string                  // The UTC day renders are counted for
+	renders  map[string]int          // Per key id, the renders asked for on day
+}
+
+func NewAuth(required bool, keys *KeyStore, store *JobStore) (*Auth, error) {
+	var day = today()
+
+	renders, err := store.LoadUsage(day)
+	if err != nil {
+		return nil, err
+	}
+
+	// Clients get a release to start sending keys before they are required
+	if !required {
+		slog.Warn("API keys are not required, anyone can render. Issue keys with the keys command and set requireApiKey, it will be on by default in the next release")
+	}
+
+	var secret = make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return &Auth{
+		required: required,
+		keys:     keys,
+		store:    store,
+		secret:   secret,
+		limiters: make(map[string]*rateLimiter),
+		day:      day,
+		renders:  renders,
+	}, nil
+}
+
+// The key of the request. If there is none the client has been answered, and ok is false.
+// When keys aren't required every request is let through, with an empty key.
+func (a *Auth) Check(w http.ResponseWriter, r *http.Request) (key APIKey, ok bool) {
+	if !a.required {
+		return APIKey{}, true
+	}
+
+	token, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mit-hjerte"`)
+		writeError(w, http.StatusUnauthorized, "missing API key, send it as Authorization: Bearer <key>")
+		return APIKey{}, false
+	}
+
+	key, ok = a.keys.Lookup(token)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mit-hjerte", error="invalid_token"`)
+		writeError(w, http.StatusUnauthorized, "invalid or revoked API key")
+		return APIKey{}, false
+	}
+
+	return key, true
+}
+
+// Count a render submission of the key against its rate limit. If it's over the limit the client has been answered
+// with 429, and it returns false.
+func (a *Auth) Limit(w http.ResponseWriter, key APIKey) bool {
+	if key.RateLimit <= 0 {
+		return true
+	}
+
+	a.mu.Lock()
+	var limiter = a.limiters[key.Id]
+	if limiter == nil {
+		limiter = &rateLimiter{}
+		a.limiters[key.Id] = limiter
+	}
+	allowed, wait := limiter.take(key.RateLimit, time.Now())
+	a.mu.Unlock()
+
+	if !allowed {
+		setRetryAfter(w, wait)
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("rate limit of %d renders per minute reached", key.RateLimit))
+		return false
+	}
+
+	return true
+}
+
+// Where a browser can follow the progress of the job for the owner. EventSource can't send the API key,
+// so the URL carries a token instead, signed for the job and the key, that can be used for EVENTS_TOKEN_TTL.
+// The job id alone isn't enough, job ids show up in URLs, logs and callbacks.
+func (a *Auth) EventsURL(id string, owner string) string {
+	var url = "/api/jobs/" + id + "/events"
+	if !a.required {
+		return url
+	}
+
+	var expires = strconv.FormatInt(time.Now().Add(EVENTS_TOKEN_TTL).Unix(), 10)
+	return url + "?token=" + owner + "." + expires + "." + a.sign(id, owner, expires)
+}
+
+// The owner of the events token of the request for the job. If it isn't valid the client has been answered, and ok is false.
+func (a *Auth) CheckEventsToken(w http.ResponseWriter, r *http.Request, id string) (owner string, ok bool) {
+	var parts = strings.Split(r.URL.Query().Get("token"), ".")
+	if len(parts) == 3 && hmac.Equal([]byte(parts[2]), []byte(a.sign(id, parts[0], parts[1]))) {
+		expires, err := strconv.ParseInt(parts[1], 10, 64)
+		if err == nil && time.Now().Unix() < expires {
+			return parts[0], true
+		}
+	}
+
+	writeError(w, http.StatusUnauthorized, "invalid or expired token, get the job again for a new eventsUrl")
+	return "", false
+}
+
+func (a *Auth) sign(id string, owner string, expires string) string {
+	var mac = hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(id + "." + owner + "." + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returned by ChargeRender when the daily quota of the key is used up
+type QuotaError struct {
+	Quota      int
+	RetryAfter time.Duration // Until the quota is reset at midnight UTC
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("daily quota of %d renders used up", e.Quota)
+}
+
+// Count a render against the daily quota of the key. Returns a *QuotaError if the quota is used up.
+// Only renders count, so this is called by Submit once it knows the request isn't replayed or shared with another job.
+func (a *Auth) ChargeRender(key APIKey) error {
+	if key.Id == "" || key.DailyQuota == 0 {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.rollDay()
+
+	if a.renders[key.Id] >= key.DailyQuota {
+		var midnight = time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return &QuotaError{Quota: key.DailyQuota, RetryAfter: time.Until(midnight)}
+	}
+
+	a.renders[key.Id]++
+	a.saveUsage(key.Id)
+
+	return nil
+}
+
+// Start counting again on a new day. Must be called with the lock held.
+func (a *Auth) rollDay() {
+	if day := today(); day != a.day {
+		a.day = day
+		a.renders = make(map[string]int)
+	}
+}
+
+// Must be called with the lock held
+func (a *Auth) saveUsage(id string) {
+	if err := a.store.SaveUsage(id, a.day, a.renders[id]); err != nil {
+		slog.Error("saving API key usage", "key", id, "error", err)
+	}
+}
+
+func today() string {
+	return time.Now().UTC().Format(time.DateOnly)
+}
+
+// The key in the Authorization header, "Bearer <key>"
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+}
+
+// A token bucket that holds a minute of requests and fills up again over a minute
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// Take a token if there is one, otherwise tell how long until there is
+func (l *rateLimiter) take(perMinute int, now time.Time) (bool, time.Duration) {
+	var capacity = float64(perMinute)
+	var perSecond = capacity / 60
+
+	if l.last.IsZero() {
+		l.tokens = capacity
+	} else {
+		l.tokens = min(capacity, l.tokens+now.Sub(l.last).Seconds()*perSecond)
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - l.tokens) / perSecond * float64(time.Second))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An Auth that requires keys, with its own key and job databases
+func newTestAuth(t *testing.T) (*Auth, *KeyStore) {
+	t.Helper()
+
+	keys, err := OpenKeyStore(filepath.Join(t.TempDir(), API_KEY_DB))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenJobStore(filepath.Join(t.TempDir(), JOB_DB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	auth, err := NewAuth(true, keys, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return auth, keys
+}
+
+// A request with the key in the Authorization header
+func requestWithKey(token string) *http.Request {
+	var r = httptest.NewRequest(http.MethodGet, "/api/jobs/id", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestRateLimiter(t *testing.T) {
+	var limiter rateLimiter
+	var now = time.Now()
+
+	// A full minute of requests right away
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.take(3, now); !ok {
+			t.Fatalf("request %d was refused", i+1)
+		}
+	}
+
+	ok, wait := limiter.take(3, now)
+	if ok {
+		t.Fatal("the 4th request within a minute was let through")
+	}
+	if wait != 20*time.Second {
+		t.Errorf("wait %s, want 20s", wait)
+	}
+
+	// A token is back after a third of a minute
+	if ok, _ := limiter.take(3, now.Add(20*time.Second)); !ok {
+		t.Error("refused once a token was back")
+	}
+	if ok, _ := limiter.take(3, now.Add(20*time.Second)); ok {
+		t.Error("let through with the bucket empty again")
+	}
+
+	// It never holds more than a minute of requests, however long it was idle
+	var later = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		limiter.take(3, later)
+	}
+	if ok, _ := limiter.take(3, later); ok {
+		t.Error("the bucket filled up past its capacity")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	var auth, keys = newTestAuth(t)
+
+	token, key, err := keys.Issue("test", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedToken, revokedKey, err := keys.Issue("revoked", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Revoke(revokedKey.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the keys again, the file may not look changed within the same clock tick
+	if err := keys.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no key", "", http.StatusUnauthorized},
+		{"unknown key", API_KEY_PREFIX + "unknown", http.StatusUnauthorized},
+		{"revoked key", revokedToken, http.StatusUnauthorized},
+	} {
+		var w = httptest.NewRecorder()
+		if _, ok := auth.Check(w, requestWithKey(test.token)); ok || w.Code != test.status {
+			t.Errorf("%s: ok %v, status %d, want %d", test.name, ok, w.Code, test.status)
+		}
+	}
+
+	// Reads aren't rate limited, a client may poll as often as it likes
+	for i := 0; i < 5; i++ {
+		var w = httptest.NewRecorder()
+		got, ok := auth.Check(w, requestWithKey(token))
+		if !ok || got.Id != key.Id {
+			t.Fatalf("check %d: ok %v, status %d, key %s, want %s", i+1, ok, w.Code, got.Id, key.Id)
+		}
+	}
+
+	// Submissions are, to one a minute for this key
+	if !auth.Limit(httptest.NewRecorder(), key) {
+		t.Fatal("the first submission was refused")
+	}
+	var w = httptest.NewRecorder()
+	if auth.Limit(w, key) || w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("second submission: status %d, Retry-After %q, want %d and 60", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+}
+
+func TestChargeRender(t *testing.T) {
+	var auth, _ = newTestAuth(t)
+	var key = APIKey{Id: "key", DailyQuota: 2}
+
+	for i := 0; i < 2; i++ {
+		if err := auth.ChargeRender(key); err != nil {
+			t.Fatalf("render %d: %v", i+1, err)
+		}
+	}
+
+	var quotaErr *QuotaError
+	if err := auth.ChargeRender(key); !errors.As(err, &quotaErr) {
+		t.Fatalf("render over the quota: error %v, want a QuotaError", err)
+	}
+	if quotaErr.RetryAfter <= 0 || quotaErr.RetryAfter > 24*time.Hour {
+		t.Errorf("retry after %s, want until midnight", quotaErr.RetryAfter)
+	}
+
+	// Other keys have quotas of their own
+	if err := auth.ChargeRender(APIKey{Id: "other", DailyQuota: 2}); err != nil {
+		t.Errorf("another key: %v", err)
+	}
+
+	// The count was saved, so a restart doesn't reset it
+	renders, err := auth.store.LoadUsage(today())
+	if err != nil || renders["key"] != 2 {
+		t.Errorf("saved usage %v, error %v, want 2 renders", renders, err)
+	}
+
+	// The next day starts from nothing
+	auth.day = "2000-01-01"
+	if err := auth.ChargeRender(key); err != nil {
+		t.Errorf("render the next day: %v", err)
+	}
+}
+
+func TestEventsToken(t *testing.T) {
+	var auth, _ = newTestAuth(t)
+
+	// The owner the token of the URL is good for, or false if it's refused with 401
+	var check = func(url string, id string) (string, bool) {
+		var w = httptest.NewRecorder()
+		owner, ok := auth.CheckEventsToken(w, httptest.NewRequest(http.MethodGet, url, nil), id)
+		if !ok && w.Code != http.StatusUnauthorized {
+			t.Errorf("refused with status %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+		return owner, ok
+	}
+
+	var url = auth.EventsURL("job", "owner")
+	if !strings.HasPrefix(url, "/api/jobs/job/events?token=") {
+		t.Fatalf("events URL %s", url)
+	}
+
+	if owner, ok := check(url, "job"); !ok || owner != "owner" {
+		t.Errorf("valid token: owner %q, ok %v", owner, ok)
+	}
+
+	if _, ok := check(url, "other-job"); ok {
+		t.Error("the token works for another job")
+	}
+
+	// Another owner, or a later expiry, with the same MAC
+	var token = strings.TrimPrefix(url, "/api/jobs/job/events?token=")
+	var parts = strings.Split(token, ".")
+	for _, tampered := range []string{
+		"other." + parts[1] + "." + parts[2],
+		parts[0] + "." + strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10) + "." + parts[2],
+		parts[0] + "." + parts[1] + "." + strings.Repeat("0", len(parts[2])),
+		"",
+	} {
+		if _, ok := check("/api/jobs/job/events?token="+tampered, "job"); ok {
+			t.Errorf("tampered token %q was accepted", tampered)
+		}
+	}
+
+	// A token that has expired, with a valid MAC
+	var expired = strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	var expiredURL = "/api/jobs/job/events?token=owner." + expired + "." + auth.sign("job", "owner", expired)
+	if _, ok := check(expiredURL, "job"); ok {
+		t.Error("an expired token was accepted")
+	}
+}
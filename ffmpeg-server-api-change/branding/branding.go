@@ -0,0 +1,189 @@
+package branding
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// How a text is drawn on the video
+type TextStyle struct {
+	FontFile    string  `json:"fontFile"`
+	FontSize    int     `json:"fontSize"`
+	FontColor   string  `json:"fontColor"`
+	X           string  `json:"x"` // Pixels, or an ffmpeg expression like (w-text_w)/2
+	Y           string  `json:"y"`
+	LineSpacing int     `json:"lineSpacing,omitempty"`
+	FadeIn      float64 `json:"fadeIn,omitempty"`  // In seconds
+	FadeOut     float64 `json:"fadeOut,omitempty"` // In seconds
+	Wrap        int     `json:"wrap,omitempty"`    // Wrap lines at this many characters, 0 doesn't wrap
+	Indent      int     `json:"indent,omitempty"`  // Spaces before the wrapped lines of a bullet, only used for the text
+	Prefix      string  `json:"prefix,omitempty"`  // Put before every bullet, only used for the text
+}
+
+// How the bullets of the text are indented and prefixed when the template doesn't say
+const DEFAULT_BULLET_INDENT = 5
+const DEFAULT_BULLET_PREFIX = "  • "
+
+// A fixed text of the template, like the intro or the outro disclaimer
+type TextBlock struct {
+	Text     string    `json:"text"`
+	Duration float64   `json:"duration,omitempty"` // In seconds, only used for the intro and the outro
+	Style    TextStyle `json:"style"`
+}
+
+// An image drawn on top of the video, like a logo or a watermark
+type Overlay struct {
+	Image   string  `json:"image"`             // PNG, or SVG if ffmpeg is built with librsvg
+	Anchor  string  `json:"anchor"`            // "top-left", "top-right", "bottom-left", "bottom-right" or "center"
+	MarginX int     `json:"marginX,omitempty"` // Distance from the anchored edge, in pixels
+	MarginY int     `json:"marginY,omitempty"`
+	Scale   float64 `json:"scale,omitempty"`   // Size relative to the image, 0 keeps the size
+	Opacity float64 `json:"opacity,omitempty"` // 0 to 1, 0 is fully opaque like 1
+	During  string  `json:"during,omitempty"`  // "video" (the default), "intro", "sections" or "outro"
+}
+
+var anchors = map[string]bool{"": true, "top-left": true, "top-right": true, "bottom-left": true, "bottom-right": true, "center": true}
+var windows = map[string]bool{"": true, "video": true, "intro": true, "sections": true, "outro": true}
+
+// Template is the branding of a video: the logo, the intro and outro, and how titles and texts look
+type Template struct {
+	Name     string    `json:"name"`
+	Logo     TextBlock `json:"logo"`     // Shown for the whole video, left out if the text is empty
+	Intro    TextBlock `json:"intro"`    // Shown before the first option
+	Outro    TextBlock `json:"outro"`    // Shown after the last option
+	Title    TextStyle `json:"title"`    // The name of each parent option
+	Text     TextStyle `json:"text"`     // The bullets with the active sub options
+	Overlays []Overlay `json:"overlays"` // Logo images and watermarks, drawn on top of the text
+}
+
+// All templates, by name
+type Registry struct {
+	templates map[string]*Template
+}
+
+// Load every *.json template in dir
+func Load(dir string) (*Registry, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var r = &Registry{templates: make(map[string]*Template)}
+
+	for _, path := range paths {
+		tpl, err := loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, exists := r.templates[tpl.Name]; exists {
+			return nil, fmt.Errorf("template %s: name %q is used twice", path, tpl.Name)
+		}
+
+		r.templates[tpl.Name] = tpl
+	}
+
+	return r, nil
+}
+
+// Get a template by name
+func (r *Registry) Get(name string) (*Template, bool) {
+	tpl, ok := r.templates[name]
+	return tpl, ok
+}
+
+// The names of all templates, sorted
+func (r *Registry) Names() []string {
+	var names []string
+	for name := range r.templates {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func loadFile(path string) (*Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// What the file leaves out of the bullets stays at the defaults, an empty prefix turns them off
+	var tpl = Template{Text: TextStyle{Indent: DEFAULT_BULLET_INDENT, Prefix: DEFAULT_BULLET_PREFIX}}
+	if err := json.Unmarshal(data, &tpl); err != nil {
+		return nil, fmt.Errorf("template %s: %v", path, err)
+	}
+
+	// The file name is the default name
+	if tpl.Name == "" {
+		tpl.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+	}
+
+	if err := tpl.check(); err != nil {
+		return nil, fmt.Errorf("template %s: %v", path, err)
+	}
+
+	return &tpl, nil
+}
+
+// Check that the template can be rendered
+func (t *Template) check() error {
+	if t.Intro.Duration < 0 || t.Outro.Duration < 0 {
+		return fmt.Errorf("intro and outro durations must not be negative")
+	}
+
+	var styles = map[string]TextStyle{"title": t.Title, "text": t.Text}
+	if t.Logo.Text != "" {
+		styles["logo"] = t.Logo.Style
+	}
+	if t.Intro.Text != "" {
+		styles["intro"] = t.Intro.Style
+	}
+	if t.Outro.Text != "" {
+		styles["outro"] = t.Outro.Style
+	}
+
+	for i, o := range t.Overlays {
+		if _, err := os.Stat(o.Image); err != nil {
+			return fmt.Errorf("overlay %d: %v", i, err)
+		}
+		if !anchors[o.Anchor] {
+			return fmt.Errorf("overlay %d: unknown anchor %q", i, o.Anchor)
+		}
+		if !windows[o.During] {
+			return fmt.Errorf("overlay %d: unknown window %q", i, o.During)
+		}
+		if o.Opacity < 0 || o.Opacity > 1 {
+			return fmt.Errorf("overlay %d: opacity must be between 0 and 1", i)
+		}
+		if o.Scale < 0 {
+			return fmt.Errorf("overlay %d: scale must not be negative", i)
+		}
+	}
+
+	for name, style := range styles {
+		if style.FontFile == "" {
+			return fmt.Errorf("%s: fontFile is required", name)
+		}
+		if _, err := os.Stat(style.FontFile); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if style.FontSize <= 0 {
+			return fmt.Errorf("%s: fontSize must be positive", name)
+		}
+		if style.X == "" || style.Y == "" {
+			return fmt.Errorf("%s: x and y are required", name)
+		}
+		if style.Indent < 0 {
+			return fmt.Errorf("%s: indent must not be negative", name)
+		}
+	}
+
+	return nil
+}
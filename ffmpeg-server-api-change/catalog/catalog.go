@@ -0,0 +1,331 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"server/probe"
+)
+
+type Kind string
+
+const (
+	Video Kind = "video"
+	Audio Kind = "audio"
+)
+
+// Only these files are picked up when scanning, the render pipeline relies on the extensions
+const VIDEO_EXT = ".mp4"
+const AUDIO_EXT = ".aac"
+
+// Looking up a name the catalog doesn't know scans the directories again, so new assets are found without a restart,
+// but at most this often, so requests for unknown names can't keep the server scanning
+const RELOAD_ON_MISS_INTERVAL = 30 * time.Second
+
+// An audio or video file that renders can use
+type Asset struct {
+	Name     string    `json:"name"` // Path relative to the asset directory, without extension
+	Kind     Kind      `json:"kind"`
+	Path     string    `json:"-"`        // Where the file is on the server, never shown to clients
+	Duration float64   `json:"duration"` // In seconds
+	Codec    string    `json:"codec"`
+	Language string    `json:"language,omitempty"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+}
+
+// The optional manifest, it can add assets outside of the scanned directories and set their language
+type Manifest struct {
+	DefaultLanguage string          `json:"defaultLanguage"`
+	Assets          []ManifestEntry `json:"assets"`
+}
+
+type ManifestEntry struct {
+	Kind     Kind   `json:"kind"`
+	Name     string `json:"name"`
+	Path     string `json:"path,omitempty"` // Defaults to the asset directory + name + extension
+	Language string `json:"language,omitempty"`
+}
+
+// Catalog knows every video and audio clip on disk
+type Catalog struct {
+	VideoDir string
+	AudioDir string
+	Manifest string // Path of the manifest, it's fine if it doesn't exist
+	Prober   *probe.Prober
+
+	mu        sync.RWMutex
+	videos    map[string]Asset
+	audio     map[string]Asset
+	scannedAt time.Time // When the directories were last scanned, also when that failed
+
+	reloading sync.Mutex // Held while a missing name reloads the catalog, so only one reload runs
+}
+
+// Make a catalog and load it
+func Load(videoDir string, audioDir string, manifest string, prober *probe.Prober) (*Catalog, error) {
+	var c = &Catalog{
+		VideoDir: videoDir,
+		AudioDir: audioDir,
+		Manifest: manifest,
+		Prober:   prober,
+	}
+
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Scan the asset directories and read the manifest again, replacing what the catalog knew
+func (c *Catalog) Reload() error {
+	manifest, err := readManifest(c.Manifest)
+	if err != nil {
+		return err
+	}
+
+	var languages = make(map[string]string)
+	var videos = make(map[string]Asset)
+	var audio = make(map[string]Asset)
+
+	var paths = make(map[string]string)
+
+	// Assets listed in the manifest
+	for _, entry := range manifest.Assets {
+		var path = entry.Path
+
+		switch entry.Kind {
+		case Video:
+			if path == "" {
+				path = filepath.Join(c.VideoDir, entry.Name+VIDEO_EXT)
+			}
+		case Audio:
+			if path == "" {
+				path = filepath.Join(c.AudioDir, entry.Name+AUDIO_EXT)
+			}
+		default:
+			return fmt.Errorf("catalog manifest: asset %q has unknown kind %q", entry.Name, entry.Kind)
+		}
+
+		paths[string(entry.Kind)+":"+entry.Name] = path
+		if entry.Language != "" {
+			languages[string(entry.Kind)+":"+entry.Name] = entry.Language
+		}
+	}
+
+	// Assets found on disk, the manifest wins if it lists the same name
+	if err := scan(c.VideoDir, Video, VIDEO_EXT, paths); err != nil {
+		return err
+	}
+	if err := scan(c.AudioDir, Audio, AUDIO_EXT, paths); err != nil {
+		return err
+	}
+
+	for key, path := range paths {
+		var kind, name, _ = strings.Cut(key, ":")
+
+		asset, err := c.load(Kind(kind), name, path)
+		if err != nil {
+			slog.Warn("skipping asset", "error", err)
+			continue
+		}
+
+		asset.Language = firstNonEmpty(languages[key], asset.Language, manifest.DefaultLanguage)
+
+		if asset.Kind == Video {
+			videos[name] = asset
+		} else {
+			audio[name] = asset
+		}
+	}
+
+	slog.Info("catalog loaded", "videos", len(videos), "audio", len(audio))
+
+	c.mu.Lock()
+	c.videos = videos
+	c.audio = audio
+	c.scannedAt = time.Now()
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Look up a base video by name, e.g. "Atrieflimren_Long"
+func (c *Catalog) Video(name string) (Asset, bool) {
+	return c.lookup(name, func() map[string]Asset { return c.videos })
+}
+
+// Look up an audio clip by name, e.g. "Atrieflimren/0/1"
+func (c *Catalog) Audio(name string) (Asset, bool) {
+	return c.lookup(name, func() map[string]Asset { return c.audio })
+}
+
+// Look up the name in the assets, reloading the catalog if it isn't there and wasn't loaded recently
+func (c *Catalog) lookup(name string, assets func() map[string]Asset) (Asset, bool) {
+	var find = func() (Asset, bool, time.Time) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+
+		asset, ok := assets()[name]
+		return asset, ok, c.scannedAt
+	}
+
+	asset, ok, scannedAt := find()
+	if ok || time.Since(scannedAt) < RELOAD_ON_MISS_INTERVAL {
+		return asset, ok
+	}
+
+	c.reloading.Lock()
+	defer c.reloading.Unlock()
+
+	// Another lookup may have reloaded it while this one waited
+	if asset, ok, scannedAt = find(); ok || time.Since(scannedAt) < RELOAD_ON_MISS_INTERVAL {
+		return asset, ok
+	}
+
+	if err := c.Reload(); err != nil {
+		slog.Error("reloading catalog", "error", err)
+
+		// Don't try again on every lookup
+		c.mu.Lock()
+		c.scannedAt = time.Now()
+		c.mu.Unlock()
+
+		return Asset{}, false
+	}
+
+	asset, ok, _ = find()
+	return asset, ok
+}
+
+// All base videos, sorted by name
+func (c *Catalog) Videos() []Asset {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return sorted(c.videos)
+}
+
+// All audio clips, sorted by name
+func (c *Catalog) AudioClips() []Asset {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return sorted(c.audio)
+}
+
+func (c *Catalog) load(kind Kind, name string, path string) (Asset, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Asset{}, err
+	}
+
+	probed, err := c.Prober.Probe(context.Background(), path)
+	if err != nil {
+		return Asset{}, fmt.Errorf("probing %s: %v", path, err)
+	}
+
+	var asset = Asset{
+		Name:     name,
+		Kind:     kind,
+		Path:     path,
+		Duration: probed.Duration,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	}
+
+	// The codec and language of the stream that matters for the kind of asset
+	var stream, ok = probed.Audio()
+	if kind == Video {
+		stream, ok = probed.Video()
+	}
+	if ok {
+		asset.Codec = stream.CodecName
+		asset.Language = stream.Language
+	}
+
+	return asset, nil
+}
+
+// Walk dir and add every file with the extension to paths, keyed by kind and name
+func scan(dir string, kind Kind, ext string, paths map[string]string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Renders write their output here, it's not an asset
+		if d.IsDir() && d.Name() == "output" {
+			return filepath.SkipDir
+		}
+
+		if d.IsDir() || filepath.Ext(path) != ext {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		var key = string(kind) + ":" + filepath.ToSlash(strings.TrimSuffix(rel, ext))
+		if _, ok := paths[key]; !ok {
+			paths[key] = path
+		}
+
+		return nil
+	})
+}
+
+func readManifest(path string) (Manifest, error) {
+	var manifest Manifest
+
+	if path == "" {
+		return manifest, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, err
+	}
+
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("catalog manifest %s: %v", path, err)
+	}
+
+	return manifest, nil
+}
+
+func sorted(assets map[string]Asset) []Asset {
+	var list = make([]Asset, 0, len(assets))
+	for _, asset := range assets {
+		list = append(list, asset)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
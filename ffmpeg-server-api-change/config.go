@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Read when no -config is given, if it exists
+const DEFAULT_CONFIG_FILE = IO_DIR + "mit-hjerte.json"
+
+// Every setting can also be given in an environment variable: the flag name in upper case with this in front,
+// e.g. MIT_HJERTE_PUBLIC_URL for -public-url
+const CONFIG_ENV_PREFIX = "MIT_HJERTE_"
+
+// Where the videos can be downloaded, the file name of the video is put after it
+const PUBLIC_URL = "https://mit-hjerte.dk/download?url="
+
+// The certificate of api.mit-hjerte.dk
+const TLS_CERT = "/etc/letsencrypt/live/api.mit-hjerte.dk/fullchain.pem"
+const TLS_KEY = "/etc/letsencrypt/live/api.mit-hjerte.dk/privkey.pem"
+
+// The x264 preset and quality (0 is lossless, 51 is worst) both render paths use
+const ENCODER_PRESET = "ultrafast"
+const VIDEO_CRF = 31
+
+var X264_PRESETS = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow", "placebo"}
+
+// A time.Duration written as "90s" or "30m" in the config file
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30m\": %w", err)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// Config is everything about the server that can change without recompiling it.
+// It's read from the defaults, then the config file, then the environment and then the flags, each one overriding
+// the ones before.
+type Config struct {
+	Debug     bool   `json:"debug"` // Plain HTTP on DebugAddr instead of HTTPS on Addr
+	Addr      string `json:"addr"`
+	DebugAddr string `json:"debugAddr"`
+	TLSCert   string `json:"tlsCert"`
+	TLSKey    string `json:"tlsKey"`
+
+	InternalAddr string `json:"internalAddr"` // Plain HTTP for the operators, keep it off the internet. Off if empty.
+
+	PublicURL   string `json:"publicUrl"`
+	CallbackURL string `json:"callbackUrl"` // Told about every finished job whose request has no callbackUrl
+
+	CallbackSecret       string `json:"callbackSecret"`       // Signs the callbacks, they aren't signed without
+	CallbackAllowPrivate bool   `json:"callbackAllowPrivate"` // Callbacks may go to loopback, link-local and private addresses
+
+	VideoDir        string `json:"videoDir"`
+	AudioDir        string `json:"audioDir"`
+	CatalogManifest string `json:"catalogManifest"`
+	TemplateDir     string `json:"templateDir"`
+	OutputDir       string `json:"outputDir"`
+	WorkDir         string `json:"workDir"`
+	SegmentDir      string `json:"segmentDir"` // Render in a single pass if empty
+	JobDB           string `json:"jobDb"`
+	KeyDB           string `json:"keyDb"`
+
+	KeepFailedWorkDirs bool `json:"keepFailedWorkDirs"` // Nothing removes them, only for debugging
+
+	RequireAPIKey bool `json:"requireApiKey"` // Anyone may render without, with no limits. Off for this release, on in the next.
+
+	Workers         int      `json:"workers"`
+	QueueSize       int      `json:"queueSize"`
+	ShutdownTimeout Duration `json:"shutdownTimeout"` // How long running renders get to finish on shutdown
+
+	JobMaxAge            Duration `json:"jobMaxAge"` // Finished jobs are forgotten this long after, unless their video is cached
+	CacheMaxAge          Duration `json:"cacheMaxAge"`
+	CacheMaxBytes        int64    `json:"cacheMaxBytes"`
+	SegmentCacheMaxBytes int64    `json:"segmentCacheMaxBytes"`
+	MinFreeBytes         int64    `json:"minFreeBytes"` // Not ready with less free space on the disk of an output directory
+
+	Preset        string              `json:"preset"`
+	CRF           int                 `json:"crf"`
+	StageTimeouts map[string]Duration `json:"stageTimeouts"` // Only the stages listed change, only in the file
+
+	LogLevel  string `json:"logLevel"`  // debug, info, warn or error
+	LogFormat string `json:"logFormat"` // text or json
+	LogDir    string `json:"logDir"`    // The log file of every job
+}
+
+func DefaultConfig() *Config {
+	var cfg = &Config{
+		Addr:                 ADDR,
+		DebugAddr:            DEBUGADDR,
+		InternalAddr:         INTERNAL_ADDR,
+		TLSCert:              TLS_CERT,
+		TLSKey:               TLS_KEY,
+		PublicURL:            PUBLIC_URL,
+		VideoDir:             "videos",
+		AudioDir:             "audio",
+		CatalogManifest:      CATALOG_MANIFEST,
+		TemplateDir:          TEMPLATE_DIR,
+		OutputDir:            OUTPUT_DIR,
+		WorkDir:              WORK_DIR,
+		SegmentDir:           SEGMENT_DIR,
+		JobDB:                JOB_DB,
+		KeyDB:                API_KEY_DB,
+		Workers:              JOB_WORKERS,
+		QueueSize:            JOB_QUEUE_SIZE,
+		ShutdownTimeout:      Duration(SHUTDOWN_TIMEOUT),
+		JobMaxAge:            Duration(JOB_MAX_AGE),
+		CacheMaxAge:          Duration(CACHE_MAX_AGE),
+		CacheMaxBytes:        CACHE_MAX_BYTES,
+		SegmentCacheMaxBytes: SEGMENT_CACHE_MAX_BYTES,
+		MinFreeBytes:         MIN_FREE_BYTES,
+		Preset:               ENCODER_PRESET,
+		CRF:                  VIDEO_CRF,
+		StageTimeouts:        make(map[string]Duration),
+		LogLevel:             LOG_LEVEL,
+		LogFormat:            LOG_FORMAT,
+		LogDir:               JOB_LOG_DIR,
+	}
+
+	for stage, timeout := range DEFAULT_STAGE_TIMEOUTS {
+		cfg.StageTimeouts[stage] = Duration(timeout)
+	}
+
+	return cfg
+}
+
+// Define a flag for every setting on fs, writing to c. The current values are the defaults.
+func (c *Config) flags(fs *flag.FlagSet) {
+	fs.BoolVar(&c.Debug, "debug", c.Debug, "serve plain HTTP on -debug-addr instead of HTTPS on -addr")
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address to serve HTTPS on")
+	fs.StringVar(&c.DebugAddr, "debug-addr", c.DebugAddr, "address to serve plain HTTP on in debug mode")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate chain")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key")
+	fs.StringVar(&c.InternalAddr, "internal-addr", c.InternalAddr, "address to serve /debug/info, /metrics and the detailed /readyz on with plain HTTP, only for the operators, empty to turn it off")
+
+	fs.StringVar(&c.PublicURL, "public-url", c.PublicURL, "where the videos can be downloaded, the file name is put after it")
+	fs.StringVar(&c.CallbackURL, "callback-url", c.CallbackURL, "told with a POST about every finished job whose request has no callbackUrl")
+	fs.StringVar(&c.CallbackSecret, "callback-secret", c.CallbackSecret, "key of the HMAC-SHA256 signature of every callback, best set as "+CONFIG_ENV_PREFIX+"CALLBACK_SECRET")
+	fs.BoolVar(&c.CallbackAllowPrivate, "callback-allow-private", c.CallbackAllowPrivate, "also send callbacks to loopback, link-local and private addresses, only when every client is trusted")
+
+	fs.StringVar(&c.VideoDir, "video-dir", c.VideoDir, "base videos")
+	fs.StringVar(&c.AudioDir, "audio-dir", c.AudioDir, "audio clips")
+	fs.StringVar(&c.CatalogManifest, "catalog", c.CatalogManifest, "optional manifest with extra assets and their languages")
+	fs.StringVar(&c.TemplateDir, "template-dir", c.TemplateDir, "branding templates")
+	fs.StringVar(&c.OutputDir, "output-dir", c.OutputDir, "finished videos, kept as a cache")
+	fs.StringVar(&c.WorkDir, "work-dir", c.WorkDir, "scratch directories of the renders")
+	fs.BoolVar(&c.KeepFailedWorkDirs, "keep-failed-work-dirs", c.KeepFailedWorkDirs, "keep the scratch directories of failed renders for inspection, nothing removes them")
+	fs.StringVar(&c.SegmentDir, "segment-dir", c.SegmentDir, "cache of rendered segments, render in a single pass if empty")
+	fs.StringVar(&c.JobDB, "job-db", c.JobDB, "job database")
+	fs.StringVar(&c.KeyDB, "key-db", c.KeyDB, "API key database, see the keys command")
+
+	fs.BoolVar(&c.RequireAPIKey, "require-api-key", c.RequireAPIKey, "only render for clients with an API key, and hold them to its limits")
+
+	fs.IntVar(&c.Workers, "workers", c.Workers, "number of videos rendered at the same time")
+	fs.IntVar(&c.QueueSize, "queue", c.QueueSize, "number of videos that may wait for a worker")
+	fs.DurationVar((*time.Duration)(&c.ShutdownTimeout), "shutdown-timeout", time.Duration(c.ShutdownTimeout), "how long running renders get to finish on shutdown before they are stopped and queued again")
+
+	fs.DurationVar((*time.Duration)(&c.JobMaxAge), "job-max-age", time.Duration(c.JobMaxAge), "forget finished jobs this long after they finished, unless their video is still cached")
+	fs.DurationVar((*time.Duration)(&c.CacheMaxAge), "cache-max-age", time.Duration(c.CacheMaxAge), "remove cached videos that haven't been asked for in this long")
+	fs.Int64Var(&c.CacheMaxBytes, "cache-max-bytes", c.CacheMaxBytes, "most bytes the cached videos may take up")
+	fs.Int64Var(&c.SegmentCacheMaxBytes, "segment-cache-max-bytes", c.SegmentCacheMaxBytes, "most bytes the cached segments may take up")
+	fs.Int64Var(&c.MinFreeBytes, "min-free-bytes", c.MinFreeBytes, "not ready with less free disk space than this for the output, work and segment directories")
+
+	fs.StringVar(&c.Preset, "preset", c.Preset, "x264 preset of the renders")
+	fs.IntVar(&c.CRF, "crf", c.CRF, "x264 quality of the renders, 0 is lossless and 51 is worst")
+
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "least important log lines written: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log as text or json")
+	fs.StringVar(&c.LogDir, "log-dir", c.LogDir, "log files of the jobs, with everything ffmpeg said")
+}
+
+// Parse the flags in args on fs, and read the config from the config file, the environment and the flags.
+// fs may have flags of its own, they are left alone. Returns an error listing every invalid setting.
+func LoadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	// The flags are parsed into a config of their own, only the ones given are copied over in the end
+	var fromFlags = DefaultConfig()
+	fromFlags.flags(fs)
+	var path = fs.String("config", "", "JSON config file, "+DEFAULT_CONFIG_FILE+" if it exists")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	var cfg = DefaultConfig()
+
+	// The default file is optional, one that is asked for isn't
+	var configPath = *path
+	if configPath == "" {
+		if _, err := os.Stat(DEFAULT_CONFIG_FILE); err == nil {
+			configPath = DEFAULT_CONFIG_FILE
+		}
+	}
+
+	if configPath != "" {
+		if err := cfg.readFile(configPath); err != nil {
+			return nil, fmt.Errorf("reading config %s: %w", configPath, err)
+		}
+		slog.Info("config read", "path", configPath)
+	}
+
+	var settings = flag.NewFlagSet("config", flag.ContinueOnError)
+	cfg.flags(settings)
+
+	var problems []error
+
+	settings.VisitAll(func(f *flag.Flag) {
+		var env = CONFIG_ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(env); ok {
+			if err := settings.Set(f.Name, value); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %w", env, err))
+			}
+		}
+	})
+
+	fs.Visit(func(f *flag.Flag) {
+		if settings.Lookup(f.Name) != nil {
+			settings.Set(f.Name, f.Value.String())
+		}
+	})
+
+	if len(problems) > 0 {
+		return nil, errors.Join(problems...)
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func (c *Config) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// A misspelled setting would otherwise be silently ignored
+	var decoder = json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(c)
+}
+
+// Check every setting, so a bad config stops the server at startup and not at the first render.
+// Returns an error listing every problem.
+func (c *Config) Validate() error {
+	var problems []error
+	var add = func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if c.Debug && c.DebugAddr == "" {
+		add("debugAddr must be set in debug mode")
+	}
+	if c.InternalAddr != "" && (c.InternalAddr == c.Addr || c.InternalAddr == c.DebugAddr) {
+		add("internalAddr must not be addr or debugAddr, the clients would see it")
+	}
+
+	if !c.Debug {
+		if c.Addr == "" {
+			add("addr must be set")
+		}
+
+		for _, file := range []string{c.TLSCert, c.TLSKey} {
+			if _, err := os.Stat(file); err != nil {
+				add("TLS file is missing, use debug mode to serve plain HTTP: %v", err)
+			}
+		}
+	}
+
+	if u, err := url.Parse(c.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("publicUrl must be an absolute http or https URL, got %q", c.PublicURL)
+	}
+
+	if c.CallbackURL != "" && !validCallbackURL(c.CallbackURL) {
+		add("callbackUrl must be an absolute http or https URL, got %q", c.CallbackURL)
+	}
+
+	for name, dir := range map[string]string{"videoDir": c.VideoDir, "audioDir": c.AudioDir, "templateDir": c.TemplateDir} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			add("%s %q is not a directory", name, dir)
+		}
+	}
+
+	for name, value := range map[string]string{"outputDir": c.OutputDir, "workDir": c.WorkDir, "jobDb": c.JobDB, "keyDb": c.KeyDB, "logDir": c.LogDir} {
+		if value == "" {
+			add("%s must be set", name)
+		}
+	}
+
+	// The output directory is cleaned out by the cache, the work directory after every render
+	if c.OutputDir != "" && c.WorkDir != "" && filepath.Clean(c.OutputDir) == filepath.Clean(c.WorkDir) {
+		add("outputDir and workDir must not be the same directory")
+	}
+
+	// Both are locked while they're open
+	if c.JobDB != "" && c.KeyDB != "" && filepath.Clean(c.JobDB) == filepath.Clean(c.KeyDB) {
+		add("jobDb and keyDb must not be the same file")
+	}
+
+	if c.Workers < 1 {
+		add("workers must be at least 1, got %d", c.Workers)
+	}
+	if c.QueueSize < 1 {
+		add("queueSize must be at least 1, got %d", c.QueueSize)
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		add("shutdownTimeout must be more than 0")
+	}
+
+	if c.JobMaxAge <= 0 || c.CacheMaxAge <= 0 {
+		add("jobMaxAge and cacheMaxAge must be more than 0")
+	}
+	if c.CacheMaxBytes <= 0 || c.SegmentCacheMaxBytes <= 0 {
+		add("cacheMaxBytes and segmentCacheMaxBytes must be more than 0")
+	}
+	if c.MinFreeBytes < 0 {
+		add("minFreeBytes must not be negative")
+	}
+
+	var knownPreset = false
+	for _, preset := range X264_PRESETS {
+		knownPreset = knownPreset || preset == c.Preset
+	}
+	if !knownPreset {
+		add("preset must be one of %s, got %q", strings.Join(X264_PRESETS, ", "), c.Preset)
+	}
+
+	if c.CRF < 0 || c.CRF > 51 {
+		add("crf must be between 0 and 51, got %d", c.CRF)
+	}
+
+	for stage, timeout := range c.StageTimeouts {
+		if _, ok := DEFAULT_STAGE_TIMEOUTS[stage]; !ok {
+			add("stageTimeouts: unknown stage %q", stage)
+		}
+		if timeout < 0 {
+			add("stageTimeouts: %q must not be negative", stage)
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		add("logLevel must be debug, info, warn or error, got %q", c.LogLevel)
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		add("logFormat must be text or json, got %q", c.LogFormat)
+	}
+
+	return errors.Join(problems...)
+}
+
+// The stage timeouts as the renderer takes them
+func (c *Config) stageTimeouts() map[string]time.Duration {
+	var timeouts = make(map[string]time.Duration)
+	for stage, timeout := range c.StageTimeouts {
+		timeouts[stage] = time.Duration(timeout)
+	}
+	return timeouts
+}
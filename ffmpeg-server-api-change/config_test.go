@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write a config file to a temporary directory and return its path
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	var path = filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Every setting comes from the last of the defaults, the file, the environment and the flags that sets it
+func TestLoadConfigPrecedence(t *testing.T) {
+	var path = writeTestConfig(t, `{"workers": 3, "queueSize": 7, "crf": 20, "jobMaxAge": "48h", "logLevel": "warn"}`)
+
+	t.Setenv(CONFIG_ENV_PREFIX+"QUEUE", "9")
+	t.Setenv(CONFIG_ENV_PREFIX+"CRF", "22")
+	t.Setenv(CONFIG_ENV_PREFIX+"LOG_LEVEL", "error")
+
+	var fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	var own = fs.Bool("own", false, "a flag that isn't a setting")
+
+	cfg, err := LoadConfig(fs, []string{"-config", path, "-debug", "-crf", "25", "-own"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		setting string
+		got     interface{}
+		want    interface{}
+	}{
+		{"preset from the defaults", cfg.Preset, ENCODER_PRESET},
+		{"workers from the file", cfg.Workers, 3},
+		{"jobMaxAge from the file", time.Duration(cfg.JobMaxAge), 48 * time.Hour},
+		{"queueSize from the environment over the file", cfg.QueueSize, 9},
+		{"logLevel from the environment over the file", cfg.LogLevel, "error"},
+		{"crf from the flags over the environment and the file", cfg.CRF, 25},
+		{"debug from the flags", cfg.Debug, true},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: %v, want %v", test.setting, test.got, test.want)
+		}
+	}
+
+	if !*own {
+		t.Error("the flag set's own flag wasn't parsed")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		file  string
+		env   map[string]string
+		error string
+	}{
+		{"misspelled setting", `{"workerz": 3}`, nil, "workerz"},
+		{"bad duration", `{"jobMaxAge": 30}`, nil, "duration"},
+		{"bad environment value", `{}`, map[string]string{CONFIG_ENV_PREFIX + "WORKERS": "many"}, CONFIG_ENV_PREFIX + "WORKERS"},
+		{"invalid setting", `{"workers": 0}`, nil, "workers must be at least 1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			var fs = flag.NewFlagSet("test", flag.ContinueOnError)
+			_, err := LoadConfig(fs, []string{"-config", writeTestConfig(t, test.file), "-debug"})
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("error %v, want one about %s", err, test.error)
+			}
+		})
+	}
+
+	// A config file that is asked for must exist
+	var fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	if _, err := LoadConfig(fs, []string{"-config", filepath.Join(t.TempDir(), "missing.json"), "-debug"}); err == nil {
+		t.Error("a missing config file was ignored")
+	}
+}
+
+// Validate reports every problem at once, not only the first
+func TestConfigValidateListsEveryProblem(t *testing.T) {
+	var cfg = DefaultConfig()
+	cfg.Debug = true
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("the default config in debug mode is invalid: %v", err)
+	}
+
+	cfg.Workers = 0
+	cfg.CRF = 60
+	cfg.Preset = "quick"
+	cfg.PublicURL = "videos/"
+	cfg.OutputDir = cfg.WorkDir
+	cfg.VideoDir = filepath.Join(t.TempDir(), "missing")
+
+	var err = cfg.Validate()
+	if err == nil {
+		t.Fatal("the invalid config is valid")
+	}
+
+	for _, problem := range []string{"workers", "crf", "preset", "publicUrl", "outputDir and workDir", "videoDir"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("no problem with %s in: %v", problem, err)
+		}
+	}
+}
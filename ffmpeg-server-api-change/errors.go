@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	ffmpeg "nrt/ffmpeg"
+)
+
+// An audio or video file the render needs doesn't exist
+type MissingAssetError struct {
+	Path string // The asset's name, like "audio/name.m4a", not where it is on the server
+}
+
+func (e *MissingAssetError) Error() string {
+	return "missing asset: " + e.Path
+}
+
+// ffprobe couldn't read the duration of a file
+type ProbeError struct {
+	Asset string // The asset's name as the client knows it, like "audio/name.m4a"
+	Path  string // Where the file is on the server, only for the log
+	Err   error
+}
+
+func (e *ProbeError) Error() string {
+	return fmt.Sprintf("probing %s failed: %v", e.Path, e.Err)
+}
+
+func (e *ProbeError) Unwrap() error {
+	return e.Err
+}
+
+// Turn an error from the prober for the file at path into a MissingAssetError or ProbeError for the asset
+func probeError(asset string, path string, err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return &MissingAssetError{Path: asset}
+	}
+
+	return &ProbeError{Asset: asset, Path: path, Err: err}
+}
+
+// ffmpeg exited with a non-zero status during one of the render stages
+type FFMPEGError struct {
+	Stage    string
+	Command  string
+	ExitCode int
+	Stderr   string // The last part of ffmpeg's output, the whole output is in the job's log
+	Err      error
+}
+
+func (e *FFMPEGError) Error() string {
+	return fmt.Sprintf("%s failed with exit code %d: %s", e.Stage, e.ExitCode, e.Stderr)
+}
+
+func (e *FFMPEGError) Unwrap() error {
+	return e.Err
+}
+
+// A render stage ran for longer than it may, and ffmpeg was killed
+type StageTimeoutError struct {
+	Stage   string
+	Timeout time.Duration
+}
+
+func (e *StageTimeoutError) Error() string {
+	return fmt.Sprintf("%s took longer than %s", e.Stage, e.Timeout)
+}
+
+func (e *StageTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// One of the text files for the render (file lists, titles and texts) couldn't be read or written
+type TextFileError struct {
+	Path string
+	Err  error
+}
+
+func (e *TextFileError) Error() string {
+	return fmt.Sprintf("text file %s: %v", e.Path, e.Err)
+}
+
+func (e *TextFileError) Unwrap() error {
+	return e.Err
+}
+
+// Run an ffmpeg command for the given render stage, and turn a failure into an FFMPEGError.
+// duration is the length of the output in seconds, used to report how far ffmpeg has come to progress.
+func runFFMPEG(ctx context.Context, stage string, cmd *ffmpeg.FFMPEGCommand, duration float64, progress ProgressFunc) error {
+	logFor(ctx).Debug("running ffmpeg", "stage", stage, "command", cmd.String())
+
+	// The progress is read from stdout, everything else ffmpeg says ends up in out
+	var out bytes.Buffer
+	var c = cmd.ProgressCmd(ctx)
+	c.Stderr = &out
+
+	stdout, err := c.StdoutPipe()
+	if err == nil {
+		err = c.Start()
+	}
+
+	if err == nil {
+		report(progress, stage, 0, 0)
+
+		ffmpeg.ReadProgress(stdout, func(p ffmpeg.ProgressReport) {
+			var done = 1.0
+			if !p.End && duration > 0 {
+				done = p.OutTime / duration
+			}
+			report(progress, stage, done, p.Speed)
+		})
+
+		err = c.Wait()
+	}
+
+	// Everything ffmpeg said goes in the job's log in one piece, so segments rendered at the same time don't mix
+	fmt.Fprintf(jobLogFor(ctx), "=== %s: %s\n%s\n", stage, cmd.String(), strings.TrimSpace(out.String()))
+
+	if err == nil {
+		return nil
+	}
+
+	var ffmpegErr = &FFMPEGError{
+		Stage:    stage,
+		Command:  cmd.String(),
+		ExitCode: -1,
+		Stderr:   outputTail(out.Bytes()),
+		Err:      err,
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		ffmpegErr.ExitCode = exitErr.ExitCode()
+	}
+
+	// Killed because the render was canceled or took too long, not because ffmpeg failed
+	if ctx.Err() != nil {
+		ffmpegErr.Err = ctx.Err()
+	}
+
+	return ffmpegErr
+}
+
+func report(progress ProgressFunc, stage string, done float64, speed float64) {
+	if progress != nil {
+		progress(stage, done, speed)
+	}
+}
+
+// Keep only the last part of ffmpeg's output, the error is almost always at the end
+func outputTail(out []byte) string {
+	const maxTail = 2048
+
+	if len(out) > maxTail {
+		out = out[len(out)-maxTail:]
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// JSON body for every error the API sends
+type errorBody struct {
+	Status   int    `json:"status,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Error    string `json:"error"`
+	Path     string `json:"path,omitempty"`
+	Stage    string `json:"stage,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+
+	Problems []FieldProblem `json:"problems,omitempty"`
+}
+
+// Map a render error to the HTTP status and JSON body sent to the client.
+// Clients only get asset names and render stages, never paths on the server or ffmpeg's output,
+// those are in the job's log.
+func errorBodyFrom(err error) errorBody {
+	var missing *MissingAssetError
+	var probe *ProbeError
+	var ffmpegErr *FFMPEGError
+	var textFile *TextFileError
+	var validation *ValidationError
+	var timeout *StageTimeoutError
+
+	switch {
+	case errors.As(err, &validation):
+		return errorBody{Status: http.StatusUnprocessableEntity, Type: "validation_failed", Error: err.Error(), Problems: validation.Problems}
+	case errors.As(err, &missing):
+		return errorBody{Status: http.StatusUnprocessableEntity, Type: "missing_asset", Error: err.Error(), Path: missing.Path}
+	case errors.As(err, &probe):
+		return errorBody{Status: http.StatusInternalServerError, Type: "probe_failed", Error: "probing " + probe.Asset + " failed", Path: probe.Asset}
+	case errors.As(err, &timeout):
+		return errorBody{Status: http.StatusGatewayTimeout, Type: "stage_timeout", Error: err.Error(), Stage: timeout.Stage}
+	case errors.As(err, &ffmpegErr):
+		return errorBody{Status: http.StatusInternalServerError, Type: "ffmpeg_failed", Error: ffmpegErr.Stage + " failed", Stage: ffmpegErr.Stage, ExitCode: ffmpegErr.ExitCode}
+	case errors.As(err, &textFile):
+		return errorBody{Status: http.StatusInternalServerError, Type: "text_file_failed", Error: "preparing the texts for the render failed"}
+	default:
+		return errorBody{Status: http.StatusInternalServerError, Type: "internal", Error: err.Error()}
+	}
+}
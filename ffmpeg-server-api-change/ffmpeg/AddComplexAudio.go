@@ -2,74 +2,65 @@ package ffmpeg
 
 import "strconv"
 
+// Add every audio file as an input, placed at its start time and mixed into [a]
 func (f *FFMPEGCommand) AddComplexAudio(audio *[]FFMPEGAudio) {
-	var inputs = ""
-	var command = ""
-	var amixCount = ""
-
-	// Initialise helper variables for durSoFar
-	var durSoFar float64 = 0
-	var timeTo float64 = 0
-	var timeFrom float64 = 0
-
-	// Make the input graph, add delay if applicable
-	for idx, a := range *audio {
-
-		if idx == 0 {
-			timeFrom = 0
-			inputs += ` `
-			timeTo = a.Duration
-		} else {
-			timeFrom = durSoFar
-			timeTo = durSoFar + a.Duration
-		}
-
-		inputs += `-i ` + a.Input + `.` + a.FileType + ` `
-
-		command += `[` + strconv.Itoa(idx+1) + `]`
-		command += `adelay=`
-
-		if a.Delay != 0 {
-			if idx == 0 {
-				command += strconv.FormatFloat(timeFrom, 'f', 2, 64)
-			} else {
-				command += strconv.FormatFloat(timeFrom+a.Delay, 'f', 2, 64)
-			}
-
-			command += `|`
-			command += strconv.FormatFloat(timeTo+a.Delay, 'f', 2, 64)
-		} else {
-			// No delay for this audio
-			command += strconv.FormatFloat(timeFrom, 'f', 2, 64)
-			command += `|`
-			command += strconv.FormatFloat(timeTo, 'f', 2, 64)
-		}
-
-		command += `[a` + strconv.Itoa(idx+1) + `]`
-
-		// if not last
-		if idx != len(*audio)-1 {
-			command += `;`
-		}
-
-		// Increment duration, and delay if applicable
-		durSoFar += a.Duration
-
-		if a.Delay != 0 && idx != 0 {
-			durSoFar += a.Delay
-		}
-
-		// Define all audio inputs for ffmpeg graph
-		amixCount += `[a` + strconv.Itoa(idx+1) + `]`
+	// The audio inputs come after the inputs the command already has, usually the video
+	var offset = f.inputCount()
+
+	for _, a := range *audio {
+		f.addInput(a.Input + "." + a.FileType)
 	}
 
-	command = inputs + `-filter_complex` + ` "` + command + ";" + amixCount
+	f.FilterComplex = AudioGraph(*audio, offset, 0)
+	f.HasComplexAudio = true
+}
 
-	// Define final audio mixing
-	command += ` amix=` + strconv.Itoa(len(*audio)) + `[a]`
+// Like AddComplexAudio, but the mix lasts exactly duration: padded with silence, or only silence without audio
+func (f *FFMPEGCommand) AddPaddedAudio(audio []FFMPEGAudio, duration float64) {
+	var offset = f.inputCount()
 
-	command += `"`
+	for _, a := range audio {
+		f.addInput(a.Input + "." + a.FileType)
+	}
 
-	f.Command += command
+	f.FilterComplex = AudioGraph(audio, offset, duration)
 	f.HasComplexAudio = true
 }
+
+// Make the filter graph that places every audio input at its start time and mixes them into [a].
+// audio[i] is input offset+i of the command. If duration is set, the mix is padded with silence to that length.
+// Every clip is delayed from the start of the video rather than from the clip before it,
+// so rounding never adds up and the audio stays exactly where the timeline put it.
+// Without audio the graph is silence of the duration.
+func AudioGraph(audio []FFMPEGAudio, offset int, duration float64) string {
+	var graph = ""
+	var mix = ""
+
+	if len(audio) == 0 {
+		return "anullsrc=r=48000:cl=stereo:d=" + strconv.FormatFloat(duration, 'f', 3, 64) + "[a]"
+	}
+
+	for i, a := range audio {
+		var label = "[a" + strconv.Itoa(i) + "]"
+		var delayMs = strconv.FormatInt(int64(a.Start*1000+0.5), 10)
+
+		// Same format for every clip, otherwise they can't be mixed
+		graph += "[" + strconv.Itoa(offset+i) + ":a]"
+		graph += "aformat=sample_rates=48000:channel_layouts=stereo,"
+		graph += "adelay=delays=" + delayMs + ":all=1"
+		graph += label + ";"
+
+		mix += label
+	}
+
+	// normalize=0 keeps the volume, the clips never overlap
+	graph += mix + "amix=inputs=" + strconv.Itoa(len(audio)) + ":duration=longest:normalize=0"
+
+	if duration > 0 {
+		graph += ",apad=whole_dur=" + strconv.FormatFloat(duration, 'f', 3, 64)
+	}
+
+	graph += "[a]"
+
+	return graph
+}
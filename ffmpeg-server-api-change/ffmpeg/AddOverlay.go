@@ -0,0 +1,78 @@
+package ffmpeg
+
+import "strconv"
+
+// Add an image overlay, it's drawn on top of the text
+func (f *FFMPEGCommand) AddOverlay(overlay *FFMPEGOverlay) {
+	f.Overlays = append(f.Overlays, *overlay)
+}
+
+// Make the video part of the filter graph: the drawtext chain on input 0, then every overlay on top of it.
+// The overlay images are added as inputs after the inputs the command already has.
+// The output of the graph is [v].
+func (f *FFMPEGCommand) videoGraph() string {
+	var graph = "[0:v]"
+	if len(f.Filters) > 0 {
+		graph += joinFilters(f.Filters)
+	} else {
+		graph += "null"
+	}
+	graph += "[base]"
+
+	var last = "[base]"
+
+	for i, o := range f.Overlays {
+		var input = f.addInput(o.Image)
+
+		var image = "[ov" + strconv.Itoa(i) + "]"
+		var out = "[v" + strconv.Itoa(i) + "]"
+		if i == len(f.Overlays)-1 {
+			out = "[v]"
+		}
+
+		// Prepare the image: keep its transparency, scale it and make it see-through
+		graph += ";[" + strconv.Itoa(input) + ":v]format=rgba"
+		if o.Scale > 0 && o.Scale != 1 {
+			graph += ",scale=iw*" + formatFloat(o.Scale) + ":-1"
+		}
+		if o.Opacity > 0 && o.Opacity < 1 {
+			graph += ",colorchannelmixer=aa=" + formatFloat(o.Opacity)
+		}
+		graph += image
+
+		// Place it on the video
+		var x, y = o.position()
+		graph += ";" + last + image + "overlay=x=" + x + ":y=" + y
+		if o.HasDuration {
+			graph += ":enable='between(t," + strconv.FormatFloat(o.TimeFrom, 'f', 2, 64) + "," + strconv.FormatFloat(o.TimeTo, 'f', 2, 64) + ")'"
+		}
+		graph += out
+
+		last = out
+	}
+
+	return graph
+}
+
+// The overlay's x and y as ffmpeg expressions, W and H are the video size, w and h the image size
+func (o *FFMPEGOverlay) position() (string, string) {
+	var mx = strconv.Itoa(o.MarginX)
+	var my = strconv.Itoa(o.MarginY)
+
+	switch o.Anchor {
+	case "top-right":
+		return "W-w-" + mx, my
+	case "bottom-left":
+		return mx, "H-h-" + my
+	case "bottom-right":
+		return "W-w-" + mx, "H-h-" + my
+	case "center":
+		return "(W-w)/2", "(H-h)/2"
+	default: // top-left
+		return mx, my
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
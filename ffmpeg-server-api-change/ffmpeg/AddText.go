@@ -1,19 +1,23 @@
 package ffmpeg
 
-import "strconv"
+import (
+	"strconv"
+	"strings"
+)
 
-func (f *FFMPEGCommand) AddText(txt *FFMPEGText, isLast bool) {
-	var command = `drawtext="`
+// Add a drawtext filter for txt to the video filter chain
+func (f *FFMPEGCommand) AddText(txt *FFMPEGText) {
+	var command = `drawtext=`
 
 	// Add text
 	if txt.TextFile {
-		command += `textfile=` + txt.Data + `:`
+		command += `textfile=` + filterValue(txt.Data) + `:`
 	} else {
-		command += `text=` + txt.Data + `:`
+		command += `text=` + filterValue(txt.Data) + `:`
 	}
 
 	// Add font
-	command += `fontfile=` + txt.FontFile + `:`
+	command += `fontfile=` + filterValue(txt.FontFile) + `:`
 
 	// Add font size
 	command += `fontsize=` + strconv.Itoa(txt.FontSize) + `:`
@@ -25,12 +29,12 @@ func (f *FFMPEGCommand) AddText(txt *FFMPEGText, isLast bool) {
 	command += `line_spacing=` + strconv.Itoa(txt.LineHeight) + `:`
 
 	// Add x and y
-	command += `x=` + strconv.Itoa(txt.X) + `:`
-	command += `y=` + strconv.Itoa(txt.Y) + `:`
+	command += `x=` + txt.X + `:`
+	command += `y=` + txt.Y + `:`
 
 	// Add time from and time to
 	if txt.HasDuration {
-		command += `enable='between(t,` + strconv.FormatFloat(txt.TimeFrom, 'f', 2, 64) + `,` + strconv.FormatFloat(txt.TimeTo+txt.Delay, 'f', 2, 64) + `)'`
+		command += `enable='between(t,` + strconv.FormatFloat(txt.TimeFrom, 'f', 2, 64) + `,` + strconv.FormatFloat(txt.TimeTo, 'f', 2, 64) + `)'`
 	} else {
 		// Remove trailing colon
 		command = command[:len(command)-1]
@@ -53,29 +57,27 @@ func (f *FFMPEGCommand) AddText(txt *FFMPEGText, isLast bool) {
 
 		// Add if statement for time less than time from
 		command += `if(lt(t,` +
-			strconv.FormatFloat(txt.TimeFrom+txt.Delay, 'f', 2, 64) + `),0,`
+			strconv.FormatFloat(txt.TimeFrom, 'f', 2, 64) + `),0,`
 
 		// Add if statement for time less than time from + fade in
 		command += `if(lt(t,` +
-			strconv.FormatFloat(txt.TimeFrom+txt.Delay+txt.FadeIn, 'f', 2, 64) +
-			`),(t-` + strconv.FormatFloat(txt.TimeFrom+txt.Delay, 'f', 2, 64) +
+			strconv.FormatFloat(txt.TimeFrom+txt.FadeIn, 'f', 2, 64) +
+			`),(t-` + strconv.FormatFloat(txt.TimeFrom, 'f', 2, 64) +
 			`)/` + strconv.FormatFloat(txt.FadeIn, 'f', 2, 64) + `,`
 
 		// Add if statement for time less than time to - fade out
 		command += `if(lt(t,` +
-			strconv.FormatFloat(txt.TimeTo+txt.Delay-txt.FadeOut, 'f', 2, 64) +
+			strconv.FormatFloat(txt.TimeTo-txt.FadeOut, 'f', 2, 64) +
 			`),1,`
 
 		// Add if statement for time less than time to
 		command += `if(lt(t,` +
-			strconv.FormatFloat(txt.TimeTo+txt.Delay, 'f', 2, 64) +
+			strconv.FormatFloat(txt.TimeTo, 'f', 2, 64) +
 			`),1-(t-` +
-			strconv.FormatFloat(txt.TimeTo+txt.Delay-txt.FadeOut, 'f', 2, 64) +
+			strconv.FormatFloat(txt.TimeTo-txt.FadeOut, 'f', 2, 64) +
 			`)/` +
 			strconv.FormatFloat(txt.FadeOut, 'f', 2, 64) +
 			`,0))))'`
-
-	} else {
 	}
 
 	//	if txt.FadeIn != 0.0 && txt.FadeOut != 0.0 {
@@ -91,13 +93,12 @@ func (f *FFMPEGCommand) AddText(txt *FFMPEGText, isLast bool) {
 	//			`)/` + strconv.FormatFloat(txt.FadeOut, 'f', 2, 64) + `,0))))'`
 	//	}
 
-	command += `"`
-
-	// Add comma to end of command if not last
-	if !isLast {
-		command += `,`
-	}
-
-	f.Command += command
+	f.AddFilter(command)
+}
 
+// Escape a value, like a path, for a filter option in a filter graph. ffmpeg unescapes it twice: first the graph,
+// where , ; [ ] split the filters, then the filter's options, where : splits them. Both take \ and ' as special.
+func filterValue(value string) string {
+	var option = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(value)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `,`, `\,`, `;`, `\;`, `[`, `\[`, `]`, `\]`).Replace(option)
 }
@@ -1,5 +1,15 @@
 package ffmpeg
 
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// How long to wait for ffmpeg's output after it has been killed
+const KILL_WAIT_DELAY = 5 * time.Second
+
 type Choices struct {
 	Id        int
 	Text      string
@@ -8,44 +18,142 @@ type Choices struct {
 }
 
 func (f *FFMPEGCommand) Configure() {
-	command := "ffmpeg"
-	command += ` `
+	var args = []string{}
 
 	// Set input differently if input is a list of files
 	if f.InputFile {
-		command += "-f concat -i " + f.Input + ".txt" + ` `
+		args = append(args, "-f", "concat", "-i", f.Input+".txt")
 	} else {
-		command += "-i " + f.Input + " "
+		args = append(args, "-i", f.Input)
 	}
 
 	if f.ShouldCopy {
-		command += "-c copy "
+		args = append(args, "-c", "copy")
 	} // Implement Audio and Video codecs
 
-	f.Command = command
+	f.Args = args
+}
 
+// Add a raw filter to the video filter chain, e.g. a prebuilt drawtext filter
+func (f *FFMPEGCommand) AddFilter(filter string) {
+	f.Filters = append(f.Filters, filter)
 }
 
-func (f *FFMPEGCommand) MakeCommand(Preset string, APreset string, final bool) string {
-	command := f.Command
+// Finish the argument vector with the filters, presets and output file, and return it
+func (f *FFMPEGCommand) MakeCommand(Preset string, APreset string, final bool) []string {
+	var args []string
 
-	if f.HasComplexAudio {
-		command += ` -map 0:v -map "[a]"`
+	if len(f.Overlays) > 0 {
+		// Overlays need their own inputs, so the text and the overlays go in one complex filter graph
+		var graph = f.videoGraph()
+		args = f.Args
+
+		if f.HasComplexAudio {
+			args = append(args, "-filter_complex", graph+";"+f.FilterComplex, "-map", "[v]", "-map", "[a]")
+		} else {
+			args = append(args, "-filter_complex", graph, "-map", "[v]", "-map", "0:a?")
+		}
+	} else {
+		args = f.Args
+
+		// The whole filter chain is a single argument, ffmpeg parses it itself
+		if len(f.Filters) > 0 {
+			args = append(args, "-vf", joinFilters(f.Filters))
+		}
+
+		if f.HasComplexAudio {
+			args = append(args, "-filter_complex", f.FilterComplex, "-map", "0:v", "-map", "[a]")
+		}
 	}
 
+	// The video encoding is up to the caller, it's added to Args before
 	if final {
-		command += ` -c:a copy -movflags +faststart -tune fastdecode -crf 31 -pix_fmt yuv420p -level 4.2 `
+		args = append(args, "-c:a", "copy", "-movflags", "+faststart")
 	}
 
 	if Preset != "" {
-		command += ` -preset:v ` + Preset + ` `
+		args = append(args, "-preset:v", Preset)
 	}
 
 	if APreset != "" {
-		command += ` -preset:a ` + APreset + ` `
+		args = append(args, "-preset:a", APreset)
+	}
+
+	args = append(args, f.Out+"."+f.FileType)
+
+	f.Args = args
+
+	return args
+}
+
+func joinFilters(filters []string) string {
+	return strings.Join(filters, ",")
+}
+
+// Number of inputs the command has so far
+func (f *FFMPEGCommand) inputCount() int {
+	var count = 0
+	for i, arg := range f.Args {
+		if arg == "-i" && i+1 < len(f.Args) {
+			count++
+		}
+	}
+	return count
+}
+
+// Add an input after the inputs the command already has, so it comes before any output options
+// Returns the index of the new input
+func (f *FFMPEGCommand) addInput(path string) int {
+	var at = 0
+	for i, arg := range f.Args {
+		if arg == "-i" && i+1 < len(f.Args) {
+			at = i + 2
+		}
 	}
 
-	command += f.Out + "." + f.FileType
+	var args = make([]string, 0, len(f.Args)+2)
+	args = append(args, f.Args[:at]...)
+	args = append(args, "-i", path)
+	args = append(args, f.Args[at:]...)
+
+	var index = f.inputCount()
+	f.Args = args
+
+	return index
+}
+
+// Make the ffmpeg process for the command, the arguments are passed as is without a shell
+func (f *FFMPEGCommand) Cmd(ctx context.Context) *exec.Cmd {
+	return command(ctx, f.Args)
+}
+
+// ffmpeg with the given arguments, killed together with everything it started when ctx is done
+func command(ctx context.Context, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	setProcessGroup(cmd)
+
+	// Don't wait forever for the output pipes once ffmpeg is killed
+	cmd.WaitDelay = KILL_WAIT_DELAY
+
+	return cmd
+}
+
+// The command as it would be typed in a shell, for logging
+func (f *FFMPEGCommand) String() string {
+	var quoted = []string{"ffmpeg"}
+
+	for _, arg := range f.Args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// Quote an argument with single quotes if the shell would otherwise split or expand it
+func shellQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`*?[]{}()<>|&;#~!") {
+		return arg
+	}
 
-	return command
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
 }
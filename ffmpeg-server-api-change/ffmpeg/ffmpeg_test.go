@@ -0,0 +1,110 @@
+package ffmpeg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFilterValue(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  string
+	}{
+		{"work/job/title.txt", "work/job/title.txt"},
+		{"C:/fonts/a.ttf", `C\\:/fonts/a.ttf`},
+		{"it's", `it\\\'s`},
+		{`back\slash`, `back\\\\slash`},
+		{"a,b;c[d]", `a\,b\;c\[d\]`},
+		{"100%", "100%"},
+	} {
+		if got := filterValue(test.value); got != test.want {
+			t.Errorf("filterValue(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+// The paths of the text and the font are escaped, the times come out as they are
+func TestAddText(t *testing.T) {
+	var f FFMPEGCommand
+	f.AddText(&FFMPEGText{
+		TextFile:    true,
+		Data:        "work/it's, done/title.txt",
+		FontFile:    "/srv/mit:hjerte/font.ttf",
+		FontSize:    52,
+		FontColor:   "black",
+		LineHeight:  2,
+		X:           "52",
+		Y:           "64",
+		HasDuration: true,
+		TimeFrom:    5,
+		TimeTo:      10,
+		FadeIn:      1,
+		FadeOut:     2,
+	})
+
+	var want = `drawtext=textfile=work/it\\\'s\, done/title.txt:fontfile=/srv/mit\\:hjerte/font.ttf:fontsize=52:fontcolor=black:line_spacing=2:x=52:y=64:` +
+		`enable='between(t,5.00,10.00)':alpha='if(lt(t,5.00),0,if(lt(t,6.00),(t-5.00)/1.00,if(lt(t,8.00),1,if(lt(t,10.00),1-(t-8.00)/2.00,0))))'`
+
+	if len(f.Filters) != 1 || f.Filters[0] != want {
+		t.Errorf("filters %q, want %q", f.Filters, want)
+	}
+}
+
+// The whole filter chain is a single argument, and the output file comes last
+func TestMakeCommand(t *testing.T) {
+	var f = FFMPEGCommand{Input: "in put.mp4", Out: "out", FileType: "mp4"}
+	f.Configure()
+	f.AddFilter("drawtext=text=a")
+	f.AddFilter("drawtext=text=b")
+	f.Args = append(f.Args, "-c:v", "libx264")
+
+	var want = []string{"-i", "in put.mp4", "-c:v", "libx264", "-vf", "drawtext=text=a,drawtext=text=b", "-c:a", "copy", "-movflags", "+faststart", "out.mp4"}
+	if got := f.MakeCommand("", "", true); !reflect.DeepEqual(got, want) {
+		t.Errorf("args %q, want %q", got, want)
+	}
+}
+
+// Overlay images are inputs of their own, their paths are arguments and never part of the filter graph
+func TestMakeCommandOverlay(t *testing.T) {
+	var f = FFMPEGCommand{Input: "in.mp4", Out: "out", FileType: "mp4"}
+	f.Configure()
+	f.AddFilter("drawtext=text=a")
+	f.AddOverlay(&FFMPEGOverlay{Image: "logos/it's, [new].png", Anchor: "top-right", MarginX: 10, MarginY: 20})
+
+	var args = f.MakeCommand("", "", false)
+
+	var want = []string{
+		"-i", "in.mp4", "-i", "logos/it's, [new].png",
+		"-filter_complex", "[0:v]drawtext=text=a[base];[1:v]format=rgba[ov0];[base][ov0]overlay=x=W-w-10:y=20[v]",
+		"-map", "[v]", "-map", "0:a?", "out.mp4",
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("args %q, want %q", args, want)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, test := range []struct {
+		arg  string
+		want string
+	}{
+		{"-i", "-i"},
+		{"videos/a.mp4", "videos/a.mp4"},
+		{"", "''"},
+		{"a b", "'a b'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+		{"[v]", "'[v]'"},
+		{"a;b", "'a;b'"},
+	} {
+		if got := shellQuote(test.arg); got != test.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", test.arg, got, test.want)
+		}
+	}
+
+	var f = FFMPEGCommand{Args: []string{"-i", "in put.mp4", "out.mp4"}}
+	if got := f.String(); !strings.HasPrefix(got, "ffmpeg -i 'in put.mp4' out.mp4") {
+		t.Errorf("String() = %s", got)
+	}
+}
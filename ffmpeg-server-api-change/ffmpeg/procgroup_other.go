@@ -0,0 +1,8 @@
+//go:build !unix
+
+package ffmpeg
+
+import "os/exec"
+
+// No process groups here, the context only kills ffmpeg itself
+func setProcessGroup(cmd *exec.Cmd) {}
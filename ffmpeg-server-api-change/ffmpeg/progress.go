@@ -0,0 +1,57 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// A block of ffmpeg's -progress output, sent about twice a second while it runs
+type ProgressReport struct {
+	OutTime float64 // Seconds of output written so far
+	Speed   float64 // Times realtime, 0 if ffmpeg doesn't know yet
+	End     bool    // The last report, ffmpeg is done writing
+}
+
+// Like Cmd, but ffmpeg writes its progress as key=value lines to stdout instead of the stats line on stderr
+func (f *FFMPEGCommand) ProgressCmd(ctx context.Context) *exec.Cmd {
+	var args = append([]string{"-progress", "pipe:1", "-nostats"}, f.Args...)
+
+	return command(ctx, args)
+}
+
+// Read ffmpeg's -progress output and call fn at the end of every block.
+// Returns when r is closed or fails.
+func ReadProgress(r io.Reader, fn func(ProgressReport)) error {
+	var report ProgressReport
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "out_time_us", "out_time_ms":
+			// Both are in microseconds, out_time_ms is misnamed in ffmpeg
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				report.OutTime = float64(us) / 1e6
+			}
+		case "speed":
+			// "1.5x", or "N/A" at the start
+			if speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64); err == nil {
+				report.Speed = speed
+			}
+		case "progress":
+			// Closes the block, "continue" or "end"
+			report.End = value == "end"
+			fn(report)
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,79 @@
+package ffmpeg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Captured from ffmpeg 6 with -progress pipe:1 -nostats, cut down to three blocks
+const CAPTURED_PROGRESS = `frame=0
+fps=0.00
+stream_0_0_q=0.0
+bitrate=N/A
+total_size=N/A
+out_time_us=N/A
+out_time_ms=N/A
+out_time=N/A
+dup_frames=0
+drop_frames=0
+speed=N/A
+progress=continue
+frame=120
+fps=0.00
+stream_0_0_q=29.0
+bitrate= 412.3kbits/s
+total_size=247404
+out_time_us=4800000
+out_time_ms=4800000
+out_time=00:00:04.800000
+dup_frames=0
+drop_frames=0
+speed=9.58x
+progress=continue
+frame=250
+fps=248.51
+stream_0_0_q=-1.0
+bitrate= 398.1kbits/s
+total_size=497664
+out_time_us=10000000
+out_time_ms=10000000
+out_time=00:00:10.000000
+dup_frames=0
+drop_frames=0
+speed=9.94x
+progress=end
+`
+
+func TestReadProgress(t *testing.T) {
+	var reports []ProgressReport
+
+	if err := ReadProgress(strings.NewReader(CAPTURED_PROGRESS), func(p ProgressReport) {
+		reports = append(reports, p)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// N/A leaves the values at what they were
+	var want = []ProgressReport{
+		{OutTime: 0, Speed: 0, End: false},
+		{OutTime: 4.8, Speed: 9.58, End: false},
+		{OutTime: 10, Speed: 9.94, End: true},
+	}
+	if !reflect.DeepEqual(reports, want) {
+		t.Errorf("reports %+v, want %+v", reports, want)
+	}
+}
+
+// Output cut off before the end of a block doesn't report it
+func TestReadProgressCutOff(t *testing.T) {
+	var reports int
+
+	ReadProgress(strings.NewReader("out_time_us=1000000\nspeed=1x\n"), func(p ProgressReport) {
+		reports++
+	})
+
+	if reports != 0 {
+		t.Errorf("%d reports of an unfinished block", reports)
+	}
+}
@@ -1,19 +1,23 @@
 package ffmpeg
 
 type FFMPEG interface {
-	AddAudio()
 	AddText()
 	Configure()
 	CombineVideoAudio()
 	StitchVideos()
 	StitchAudio()
 
-	MakeCommand() string
+	MakeCommand() []string
 }
 
+// FFMPEGCommand builds the argument vector for a single ffmpeg run.
+// Args holds every argument after the ffmpeg binary, Filters the video filter chain.
 type FFMPEGCommand struct {
 	Flags           []string
-	Command         string
+	Args            []string
+	Filters         []string
+	Overlays        []FFMPEGOverlay
+	FilterComplex   string
 	InputFile       bool
 	Input           string
 	Out             string
@@ -31,21 +35,34 @@ type FFMPEGText struct {
 	FontSize    int
 	FontColor   string
 	LineHeight  int
-	X           int
-	Y           int
+	X           string // Pixels, or an ffmpeg expression like (w-text_w)/2
+	Y           string
 	HasDuration bool
-	Delay       float64
 	TimeFrom    float64
 	TimeTo      float64
 	FadeIn      float64
 	FadeOut     float64
 }
 
+// An image drawn on top of the video, like a logo or a watermark.
+// PNG keeps its transparency, SVG works when ffmpeg is built with librsvg.
+type FFMPEGOverlay struct {
+	Image       string
+	Anchor      string // "top-left", "top-right", "bottom-left", "bottom-right" or "center"
+	MarginX     int    // Distance from the anchored edge, in pixels
+	MarginY     int
+	Scale       float64 // Size relative to the image, 0 keeps the size
+	Opacity     float64 // 0 to 1, 0 is fully opaque like 1
+	HasDuration bool
+	TimeFrom    float64
+	TimeTo      float64
+}
+
 type FFMPEGAudio struct {
 	Input    string
 	FileType string
+	Start    float64 // When the audio starts, in seconds from the start of the output
 	Duration float64
-	Delay    float64
 }
 
 type FFMPEGVideo struct {
@@ -2,12 +2,11 @@ package fileutil
 
 import (
 	"bufio"
-	"bytes"
 	"os"
 	"strings"
 )
 
-// ReadLines reads the lines from the file at the given path and returns them as a slice of strings.
+// ReadLines reads the paths from the ffmpeg concat list at the given path and returns them as a slice of strings.
 func ReadLines(path string) ([]string, error) {
 	// Open the file.
 	file, err := os.Open(path)
@@ -20,13 +19,21 @@ func ReadLines(path string) ([]string, error) {
 	scanner := bufio.NewScanner(file)
 	scanner.Buffer(make([]byte, 1024*1024), 1024*1024) // Use a 1MB buffer
 
-	// Read the lines from the file and store them in a bytes.Buffer. Also discard the first word, and only take the string withing the single quotes
-	var buf bytes.Buffer
+	// Read the lines from the file. Discard the first word, and only take the string within the single quotes.
+	// The path itself may contain spaces, so everything after the first word is used.
+	var lines []string
 	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Fields(line)
-		buf.WriteString(strings.Trim(fields[1], "'"))
-		buf.WriteByte('\n')
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		lines = append(lines, unquoteConcatPath(strings.TrimSpace(fields[1])))
 	}
 
 	// Check for any errors that occurred while scanning the file.
@@ -34,9 +41,17 @@ func ReadLines(path string) ([]string, error) {
 		return nil, err
 	}
 
-	// Convert the bytes.Buffer to a slice of strings.
-	lines := strings.Split(buf.String(), "\n")
-
 	// Return the slice of lines.
 	return lines, nil
 }
+
+// ConcatEntry makes a `file '...'` line for an ffmpeg concat list, escaping single quotes in the path.
+func ConcatEntry(path string) string {
+	return "file '" + strings.ReplaceAll(path, "'", `'\''`) + "'\n"
+}
+
+// unquoteConcatPath undoes the quoting done by ConcatEntry.
+func unquoteConcatPath(path string) string {
+	path = strings.ReplaceAll(path, `'\''`, "'")
+	return strings.Trim(path, "'")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The encoders every render needs, see videoEncoding and audioEncoding
+var REQUIRED_ENCODERS = []string{"libx264", "libfdk_aac"}
+
+// Readiness is checked at most this often, a load balancer asking every second doesn't start ffmpeg every second
+const READY_CHECK_INTERVAL = 10 * time.Second
+
+// How long ffmpeg and ffprobe get to answer a check
+const READY_CHECK_TIMEOUT = 5 * time.Second
+
+// A render needs at least this much free space on the disk of every directory it writes to, unless configured otherwise
+const MIN_FREE_BYTES int64 = 5 << 30
+
+var errDiskSpaceUnsupported = errors.New("free disk space can't be measured on this system")
+
+// The outcome of a single readiness check
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type Readiness struct {
+	Ready     bool      `json:"ready"`
+	Checks    []Check   `json:"checks"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Health tells whether the server can render, and what it's running
+type Health struct {
+	config   *Config
+	renderer *Renderer
+	jobs     *JobManager
+	started  time.Time
+
+	mu   sync.Mutex
+	last *Readiness // The last readiness checked, reused for READY_CHECK_INTERVAL
+}
+
+func NewHealth(cfg *Config, renderer *Renderer, jobs *JobManager) *Health {
+	return &Health{config: cfg, renderer: renderer, jobs: jobs, started: time.Now()}
+}
+
+// Check everything a render needs. Only the last result is returned if it's recent enough,
+// except that a shutting down server is never ready.
+func (h *Health) Readiness(ctx context.Context) Readiness {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.last == nil || time.Since(h.last.CheckedAt) > READY_CHECK_INTERVAL {
+		var readiness = h.check(ctx)
+		h.last = &readiness
+	}
+
+	var readiness = *h.last
+
+	if h.jobs.ShuttingDown() {
+		readiness.Ready = false
+		readiness.Checks = append([]Check{{Name: "jobs", Detail: "shutting down"}}, readiness.Checks...)
+	}
+
+	return readiness
+}
+
+func (h *Health) check(ctx context.Context) Readiness {
+	ctx, cancel := context.WithTimeout(ctx, READY_CHECK_TIMEOUT)
+	defer cancel()
+
+	var checks []Check
+	var add = func(name string, err error) {
+		var check = Check{Name: name, OK: err == nil}
+		if err != nil {
+			check.Detail = err.Error()
+		}
+		checks = append(checks, check)
+	}
+
+	_, err := toolVersion(ctx, "ffmpeg")
+	add("ffmpeg", err)
+
+	_, err = toolVersion(ctx, h.renderer.Prober.Binary)
+	add("ffprobe", err)
+
+	add("encoders", checkEncoders(ctx))
+	add("fonts", h.checkTemplateFiles())
+
+	for _, dir := range []string{h.config.VideoDir, h.config.AudioDir} {
+		_, err := os.ReadDir(dir)
+		add("read "+dir, err)
+	}
+
+	for _, dir := range h.writableDirs() {
+		add("write "+dir, checkWritable(dir))
+		add("disk "+dir, checkFreeSpace(dir, h.config.MinFreeBytes))
+	}
+
+	var readiness = Readiness{Ready: true, Checks: checks, CheckedAt: time.Now()}
+	for _, check := range checks {
+		readiness.Ready = readiness.Ready && check.OK
+	}
+
+	return readiness
+}
+
+// The directories renders write to
+func (h *Health) writableDirs() []string {
+	var dirs []string
+	for _, dir := range []string{h.renderer.OutputDir, h.renderer.WorkDir, h.renderer.SegmentDir} {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// The first line of the tool's -version, e.g. "ffmpeg version 6.1.1 Copyright ..."
+func toolVersion(ctx context.Context, binary string) (string, error) {
+	out, err := exec.CommandContext(ctx, binary, "-hide_banner", "-version").Output()
+	if err != nil {
+		return "", fmt.Errorf("running %s: %w", binary, err)
+	}
+
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(line), nil
+}
+
+// ffmpeg must be built with every encoder in REQUIRED_ENCODERS
+func checkEncoders(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return fmt.Errorf("listing encoders: %w", err)
+	}
+
+	// Every encoder is a line like " V....D libx264              libx264 H.264 ..."
+	var available = make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		var fields = strings.Fields(line)
+		if len(fields) >= 2 {
+			available[fields[1]] = true
+		}
+	}
+
+	var missing []string
+	for _, encoder := range REQUIRED_ENCODERS {
+		if !available[encoder] {
+			missing = append(missing, encoder)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("ffmpeg has no %s encoder", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// Every font and image of every template must be readable
+func (h *Health) checkTemplateFiles() error {
+	for _, name := range h.renderer.Templates.Names() {
+		tpl, _ := h.renderer.Templates.Get(name)
+
+		files, err := templateFiles(tpl)
+		if err != nil {
+			return fmt.Errorf("template %s: %w", name, err)
+		}
+
+		for _, file := range files {
+			f, err := os.Open(file.Path)
+			if err != nil {
+				return fmt.Errorf("template %s: %w", name, err)
+			}
+			f.Close()
+		}
+	}
+
+	return nil
+}
+
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkFreeSpace(dir string, minFree int64) error {
+	free, err := freeDiskSpace(dir)
+	if errors.Is(err, errDiskSpaceUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if free < uint64(minFree) {
+		return fmt.Errorf("%s free, needs %s", formatBytes(free), formatBytes(uint64(minFree)))
+	}
+
+	return nil
+}
+
+func formatBytes(n uint64) string {
+	return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+}
+
+// What the server is running and doing, for diagnostics
+type DebugInfo struct {
+	GoVersion string    `json:"goVersion"`
+	Revision  string    `json:"revision,omitempty"` // The commit the server was built from
+	FFmpeg    string    `json:"ffmpeg"`
+	FFprobe   string    `json:"ffprobe"`
+	StartedAt time.Time `json:"startedAt"`
+	Uptime    string    `json:"uptime"`
+	CPUs      int       `json:"cpus"`
+	JobStats
+}
+
+func (h *Health) Info(ctx context.Context) DebugInfo {
+	ctx, cancel := context.WithTimeout(ctx, READY_CHECK_TIMEOUT)
+	defer cancel()
+
+	var info = DebugInfo{
+		GoVersion: runtime.Version(),
+		StartedAt: h.started,
+		Uptime:    time.Since(h.started).Round(time.Second).String(),
+		CPUs:      runtime.NumCPU(),
+		JobStats:  h.jobs.Stats(),
+	}
+
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" {
+				info.Revision = setting.Value
+			}
+		}
+	}
+
+	var err error
+	if info.FFmpeg, err = toolVersion(ctx, "ffmpeg"); err != nil {
+		info.FFmpeg = err.Error()
+	}
+	if info.FFprobe, err = toolVersion(ctx, h.renderer.Prober.Binary); err != nil {
+		info.FFprobe = err.Error()
+	}
+
+	return info
+}
+
+// /healthz answers as long as the process runs, /readyz only when it can render.
+// The checks name the server's directories and tools, so the public /readyz only tells its status,
+// see handleReadiness for the details.
+func handleHealth(mux *http.ServeMux, health *Health) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "no-cache, must-revalidate, proxy-revalidate")
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "no-cache, must-revalidate, proxy-revalidate")
+
+		if !health.Readiness(r.Context()).Ready {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+	})
+}
+
+// /readyz with every check and what failed, for the operators on the internal mux
+func handleReadiness(mux *http.ServeMux, health *Health) {
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "no-cache, must-revalidate, proxy-revalidate")
+
+		var readiness = health.Readiness(r.Context())
+		if !readiness.Ready {
+			writeJSON(w, http.StatusServiceUnavailable, readiness)
+			return
+		}
+		writeJSON(w, http.StatusOK, readiness)
+	})
+}
+
+// /debug/info tells what the server is running and doing. It's for the operators only,
+// so it goes on the internal mux, see Config.InternalAddr.
+func handleDebugInfo(mux *http.ServeMux, health *Health) {
+	mux.HandleFunc("/debug/info", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "no-cache, must-revalidate, proxy-revalidate")
+
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, health.Info(r.Context()))
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The public /readyz only tells whether the server is ready, which check failed and why is for the internal mux
+func TestReadyzDetailOnlyInternal(t *testing.T) {
+	var health = NewHealth(DefaultConfig(), &Renderer{}, newTestJobManager(t))
+	health.last = &Readiness{
+		Checks:    []Check{{Name: "ffmpeg", OK: true}, {Name: "write /srv/mit-hjerte/work", Detail: "permission denied"}},
+		CheckedAt: time.Now(),
+	}
+
+	var public = http.NewServeMux()
+	handleHealth(public, health)
+	var internal = http.NewServeMux()
+	handleReadiness(internal, health)
+
+	var w = httptest.NewRecorder()
+	public.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable || strings.TrimSpace(w.Body.String()) != `{"status":"not ready"}` {
+		t.Errorf("public: status %d, body %s, want %d without the checks", w.Code, w.Body, http.StatusServiceUnavailable)
+	}
+
+	w = httptest.NewRecorder()
+	internal.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "/srv/mit-hjerte/work") || !strings.Contains(w.Body.String(), "permission denied") {
+		t.Errorf("internal: status %d, body %s, want %d with the failed check", w.Code, w.Body, http.StatusServiceUnavailable)
+	}
+
+	health.last = &Readiness{Ready: true, Checks: []Check{{Name: "ffmpeg", OK: true}}, CheckedAt: time.Now()}
+
+	w = httptest.NewRecorder()
+	public.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"status":"ready"}` {
+		t.Errorf("public when ready: status %d, body %s", w.Code, w.Body)
+	}
+}
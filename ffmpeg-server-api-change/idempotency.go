@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// A request sent again with the same Idempotency-Key within this long gets the job of the first request
+const IDEMPOTENCY_TTL = 24 * time.Hour
+
+// Longest Idempotency-Key accepted
+const MAX_IDEMPOTENCY_KEY_LENGTH = 255
+
+// Returned by Submit when an Idempotency-Key is used again for a different request
+var ErrIdempotencyMismatch = errors.New("the Idempotency-Key was already used for a different request")
+
+// The job an Idempotency-Key was first used for
+type idempotencyRecord struct {
+	JobId       string    `json:"jobId"`
+	Fingerprint string    `json:"fingerprint"` // Of the request, so a key can't be used for another request
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func (rec idempotencyRecord) expired() bool {
+	return time.Since(rec.CreatedAt) > IDEMPOTENCY_TTL
+}
+
+// Hash the request as it was decoded, so the order of the JSON fields and whitespace don't matter
+func requestFingerprint(request JSONObj) string {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return ""
+	}
+
+	var sum = sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// The job the key was used for before, if it was used within IDEMPOTENCY_TTL and the job wasn't canceled.
+// A client that sends the request again after its job was canceled, when it went away or with DELETE,
+// wants the video after all, so it's rendered again.
+// Returns ErrIdempotencyMismatch if it was used for another request. Must be called with the lock held.
+func (m *JobManager) jobForKey(key string, request JSONObj) (*Job, error) {
+	rec, ok := m.keys[key]
+	if !ok || rec.expired() {
+		return nil, nil
+	}
+
+	if rec.Fingerprint != requestFingerprint(request) {
+		return nil, ErrIdempotencyMismatch
+	}
+
+	job, ok := m.jobs[rec.JobId]
+	if !ok || job.Status == JobCanceled {
+		return nil, nil
+	}
+
+	return job, nil
+}
+
+// Remember that the key was used for the job. Must be called with the lock held.
+func (m *JobManager) rememberKey(key string, request JSONObj, job *Job) {
+	var rec = idempotencyRecord{JobId: job.Id, Fingerprint: requestFingerprint(request), CreatedAt: time.Now()}
+
+	m.keys[key] = rec
+	if err := m.store.SaveKey(key, rec); err != nil {
+		slog.Error("saving idempotency key", "job", job.Id, "error", err)
+	}
+}
+
+// Forget the keys that are older than IDEMPOTENCY_TTL. Must be called with the lock held.
+func (m *JobManager) sweepKeys() {
+	for key, rec := range m.keys {
+		if !rec.expired() {
+			continue
+		}
+
+		delete(m.keys, key)
+		if err := m.store.DeleteKey(key); err != nil {
+			slog.Error("removing idempotency key", "error", err)
+		}
+	}
+}
@@ -0,0 +1,844 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCanceled  JobStatus = "canceled"
+	JobExpired   JobStatus = "expired" // Succeeded, but the video has been removed from the cache since
+)
+
+// Returned by Submit when the queue can't take any more jobs
+var ErrQueueFull = errors.New("job queue is full")
+
+// Returned by Cancel when the job has already finished
+var ErrJobFinished = errors.New("job has already finished")
+
+// Returned when there is no job with the given id
+var ErrJobNotFound = errors.New("job not found")
+
+// Returned by Submit once the server has started shutting down
+var ErrShuttingDown = errors.New("the server is shutting down")
+
+// A single video render, from the moment it is accepted until it has finished
+type Job struct {
+	Id       string     `json:"id"`
+	Status   JobStatus  `json:"status"`
+	URL      string     `json:"url,omitempty"`
+	Error    *errorBody `json:"error,omitempty"`
+	Progress *Progress  `json:"progress,omitempty"`
+	// Place in the queue while the job waits for a worker, 1 is next in line
+	QueuePosition int        `json:"queuePosition,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	StartedAt     *time.Time `json:"startedAt,omitempty"`
+	FinishedAt    *time.Time `json:"finishedAt,omitempty"`
+	LastUsedAt    *time.Time `json:"lastUsedAt,omitempty"` // When the video was last asked for, old videos are removed
+
+	// Where a browser can follow the progress with EventSource, only set in answers, see Auth.EventsURL
+	EventsURL string `json:"eventsUrl,omitempty"`
+
+	fileName    string
+	request     JSONObj
+	hash        string // Of what the request renders, see RequestHash
+	outputSize  int64
+	callbacks   []string           // URLs told when the job finishes
+	undelivered []string           // Callback URLs that haven't taken the finished job yet, they are told again after a restart
+	clients     map[string]int     // Per id of the API key that submitted it, the submits that still want the video
+	cancel      context.CancelFunc // Stops the render, the job's context is done afterwards
+	ctx         context.Context
+	stopped     bool         // The render was stopped by a shutdown, the job is queued again for after the restart
+	logger      *slog.Logger // Writes to the server log and the job's log file while it runs
+}
+
+// A job is finished when nothing more will happen to it
+func (j *Job) finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCanceled || j.Status == JobExpired
+}
+
+// Only the API keys that submitted the job may see it, every client may when keys aren't required and owner is empty
+func (j *Job) visibleTo(owner string) bool {
+	if owner == "" {
+		return true
+	}
+
+	_, ok := j.clients[owner]
+	return ok
+}
+
+// Every progress update a subscriber hasn't read yet is kept up to this many, the rest are dropped
+const PROGRESS_BUFFER = 16
+
+// Until a few renders have finished, assume this is how long one takes
+const DEFAULT_RENDER_ESTIMATE = time.Minute
+
+// Finished jobs are forgotten this long after they finished, unless their video is still cached
+const JOB_MAX_AGE = 30 * 24 * time.Hour
+
+// JobManager keeps track of all jobs and renders them on a fixed number of workers.
+// At most maxQueue jobs wait for a worker, Submit turns new jobs away after that.
+type JobManager struct {
+	mu            sync.Mutex
+	jobs          map[string]*Job
+	subscribers   map[string][]chan Progress   // Per job id, closed when the job finishes
+	byHash        map[string]*Job              // The job to use for a request hash: queued, running or with a cached video
+	keys          map[string]idempotencyRecord // Per Idempotency-Key, the job it was used for
+	queue         []*Job                       // Waiting for a worker, first in line first
+	ready         *sync.Cond                   // Signaled when a job is added to the queue
+	workers       int
+	maxQueue      int
+	publicURL     string // The file name of a video is put after it to make its download URL
+	cacheMaxAge   time.Duration
+	cacheMaxBytes int64
+	jobMaxAge     time.Duration
+	renderTime    time.Duration // Moving average of how long a render takes
+	renderer      *Renderer
+	store         *JobStore
+	notifier      *Notifier
+	logDir        string // Every job logs to a file of its own in here
+
+	closing     bool           // Shutting down, no new jobs are taken and the workers stop after their job
+	workersDone sync.WaitGroup // Done when every worker has stopped
+	done        chan struct{}  // Closed when the shutdown is over and nothing runs anymore
+}
+
+// Make a job manager with the jobs from the store and start its workers.
+// Jobs that were queued when the server stopped are queued again, jobs that were running are marked failed,
+// their render was cut off halfway. Callbacks that weren't delivered before the server stopped are sent again.
+func NewJobManager(renderer *Renderer, store *JobStore, notifier *Notifier, cfg *Config) (*JobManager, error) {
+	stored, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := store.LoadKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(cfg.LogDir, 0755); err != nil {
+		return nil, err
+	}
+
+	var requeue []*Job
+	var interrupted []*Job
+	var undelivered []*Job // Finished before the restart, but not every callback URL was told
+	var jobs = make(map[string]*Job)
+	var byHash = make(map[string]*Job)
+
+	for _, job := range stored {
+		job.ctx, job.cancel = context.WithCancel(context.Background())
+
+		switch job.Status {
+		case JobQueued:
+			requeue = append(requeue, job)
+			if job.hash != "" {
+				byHash[job.hash] = job
+			}
+		case JobRunning:
+			var now = time.Now()
+			job.Status = JobFailed
+			job.FinishedAt = &now
+			job.Error = &errorBody{Status: http.StatusInternalServerError, Type: "interrupted", Error: "the server stopped while the job was running"}
+			job.cancel()
+			interrupted = append(interrupted, job)
+
+			if err := store.Save(job); err != nil {
+				return nil, err
+			}
+		case JobSucceeded:
+			job.cancel()
+
+			if job.hash != "" {
+				// Only cache videos that are still there
+				info, err := os.Stat(renderer.outputPath(job.fileName))
+				if err != nil {
+					job.Status = JobExpired
+					job.URL = ""
+					if err := store.Save(job); err != nil {
+						return nil, err
+					}
+					break
+				}
+
+				job.outputSize = info.Size()
+				if job.LastUsedAt == nil {
+					job.LastUsedAt = job.FinishedAt
+				}
+				byHash[job.hash] = job
+			}
+		default:
+			job.cancel()
+		}
+
+		if job.finished() && len(job.undelivered) > 0 {
+			undelivered = append(undelivered, job)
+		}
+
+		jobs[job.Id] = job
+	}
+
+	// The jobs from before the restart are queued again in the order they came in,
+	// even if there are more than the queue holds
+	sort.Slice(requeue, func(i, j int) bool {
+		return requeue[i].CreatedAt.Before(requeue[j].CreatedAt)
+	})
+
+	for _, job := range requeue {
+		slog.Info("queueing job again after restart", "job", job.Id)
+	}
+
+	var m = &JobManager{
+		jobs:          jobs,
+		subscribers:   make(map[string][]chan Progress),
+		byHash:        byHash,
+		keys:          keys,
+		queue:         requeue,
+		workers:       cfg.Workers,
+		maxQueue:      cfg.QueueSize,
+		publicURL:     cfg.PublicURL,
+		cacheMaxAge:   time.Duration(cfg.CacheMaxAge),
+		cacheMaxBytes: cfg.CacheMaxBytes,
+		jobMaxAge:     time.Duration(cfg.JobMaxAge),
+		renderTime:    DEFAULT_RENDER_ESTIMATE,
+		renderer:      renderer,
+		store:         store,
+		notifier:      notifier,
+		logDir:        cfg.LogDir,
+		done:          make(chan struct{}),
+	}
+	m.ready = sync.NewCond(&m.mu)
+
+	m.mu.Lock()
+	for _, job := range interrupted {
+		m.notify(job)
+	}
+	for _, job := range undelivered {
+		slog.Info("sending callbacks again after restart", "job", job.Id, "urls", len(job.undelivered))
+		m.notify(job, job.undelivered...)
+	}
+	m.sweepCache()
+	m.sweepJobs()
+	m.sweepKeys()
+	m.mu.Unlock()
+
+	go m.sweeper()
+
+	m.workersDone.Add(m.workers)
+	for i := 0; i < m.workers; i++ {
+		go m.worker()
+	}
+
+	return m, nil
+}
+
+// Queue a new render of the request and return a snapshot of the job.
+// A request that renders the same video as a job that is queued, running or has its video in the cache gets that job
+// instead, so the video is only rendered once.
+// If idempotencyKey is set and was used for the same request before, that job is returned and replayed is true.
+// owner is the id of the API key the request was sent with, the job can be seen with it afterwards.
+// charge is called, if set, right before a new job is queued, its error is returned and nothing is queued if it fails.
+// Returns ErrQueueFull if too many jobs are waiting already, ErrIdempotencyMismatch if the key was used for another request.
+func (m *JobManager) Submit(request JSONObj, idempotencyKey string, owner string, charge func() error) (Job, bool, error) {
+	// Without a hash the request is rendered, just not shared
+	hash, err := m.renderer.RequestHash(request)
+	if err != nil {
+		slog.Warn("hashing request", "error", err)
+	}
+
+	var id = uuid.New().String()
+
+	// Get current date in format DD-MM-YYYY
+	date := time.Now().Format("02-01-2006")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var j = &Job{
+		Id:        id,
+		Status:    JobQueued,
+		CreatedAt: time.Now(),
+		fileName:  "mit-hjerte-" + date + "-" + id,
+		request:   request,
+		hash:      hash,
+		clients:   map[string]int{owner: 1},
+		cancel:    cancel,
+		ctx:       ctx,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closing {
+		cancel()
+		return Job{}, false, ErrShuttingDown
+	}
+
+	if idempotencyKey != "" {
+		existing, err := m.jobForKey(idempotencyKey, request)
+		if err != nil {
+			cancel()
+			return Job{}, false, err
+		}
+
+		if existing != nil {
+			cancel()
+			slog.Info("Idempotency-Key was used before", "job", existing.Id)
+			// A retry of the same submit is the same client, it's only counted again once it let go of the job
+			if existing.clients[owner] == 0 {
+				m.attach(existing, owner)
+			}
+			return m.snapshot(existing), true, nil
+		}
+	}
+
+	existing, ok := m.cached(hash)
+	if hash != "" {
+		countCache("video", ok)
+	}
+
+	if ok {
+		cancel()
+		slog.Info("request renders the same video as an earlier job", "job", existing.Id)
+		m.attach(existing, owner)
+		m.addCallback(existing, m.callbackFor(request))
+		if idempotencyKey != "" {
+			m.rememberKey(idempotencyKey, request, existing)
+		}
+		return m.snapshot(existing), false, nil
+	}
+
+	if len(m.queue) >= m.maxQueue {
+		cancel()
+		return Job{}, false, ErrQueueFull
+	}
+
+	if charge != nil {
+		if err := charge(); err != nil {
+			cancel()
+			return Job{}, false, err
+		}
+	}
+
+	if callback := m.callbackFor(request); callback != "" {
+		j.callbacks = []string{callback}
+	}
+
+	m.queue = append(m.queue, j)
+	m.jobs[id] = j
+	if hash != "" {
+		m.byHash[hash] = j
+	}
+	m.save(j)
+	if idempotencyKey != "" {
+		m.rememberKey(idempotencyKey, request, j)
+	}
+	m.ready.Signal()
+
+	return m.snapshot(j), false, nil
+}
+
+// Get a snapshot of the job with the given id, if the owner may see it
+func (m *JobManager) Get(id string, owner string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok || !job.visibleTo(owner) {
+		return Job{}, false
+	}
+
+	return m.snapshot(job), true
+}
+
+// A copy of the job with its place in the queue, must be called with the lock held
+func (m *JobManager) snapshot(j *Job) Job {
+	var job = *j
+
+	for i, queued := range m.queue {
+		if queued == j {
+			job.QueuePosition = i + 1
+			break
+		}
+	}
+
+	return job
+}
+
+// Roughly how long until there is room in the queue again: the time it takes the workers to get through
+// the jobs that are over the limit
+func (m *JobManager) RetryAfter() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rounds = (len(m.queue) - m.maxQueue + m.workers) / m.workers
+	if rounds < 1 {
+		rounds = 1
+	}
+
+	return time.Duration(rounds) * m.renderTime
+}
+
+// Follow the progress of a job. Returns a snapshot of the job and a channel with its progress,
+// which is closed when the job has finished. Call unsubscribe when done listening.
+func (m *JobManager) Subscribe(id string, owner string) (job Job, updates <-chan Progress, unsubscribe func(), ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.jobs[id]
+	if !ok || !j.visibleTo(owner) {
+		return Job{}, nil, nil, false
+	}
+
+	var ch = make(chan Progress, PROGRESS_BUFFER)
+
+	// Nothing more will happen to a finished job
+	if j.finished() {
+		close(ch)
+		return m.snapshot(j), ch, func() {}, true
+	}
+
+	m.subscribers[id] = append(m.subscribers[id], ch)
+
+	unsubscribe = func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		var subs = m.subscribers[id]
+		for i, sub := range subs {
+			if sub == ch {
+				m.subscribers[id] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}
+
+	return m.snapshot(j), ch, unsubscribe, true
+}
+
+// Count one more client of the owner that wants the video of the job, and save it. Must be called with the lock held.
+func (m *JobManager) attach(j *Job, owner string) {
+	if j.clients == nil {
+		j.clients = make(map[string]int)
+	}
+
+	// A finished job isn't waited for, but the owner may see it from now on
+	if !j.finished() {
+		j.clients[owner]++
+	} else if _, ok := j.clients[owner]; !ok {
+		j.clients[owner] = 0
+	}
+
+	m.save(j)
+}
+
+// Let go of a job for one of the clients that submitted it. Other requests for the same video share the job,
+// so it is only stopped once none of its clients wants it anymore: a queued job right away, a running job
+// once its ffmpeg has been killed. Returns a snapshot of the job, ErrJobFinished if it has already finished,
+// ErrJobNotFound if there is no such job or the owner may not see it.
+func (m *JobManager) Cancel(id string, owner string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok || !job.visibleTo(owner) {
+		return Job{}, ErrJobNotFound
+	}
+
+	if job.finished() {
+		return *job, ErrJobFinished
+	}
+
+	if job.clients[owner] > 0 {
+		job.clients[owner]--
+	}
+
+	var clients = 0
+	for _, n := range job.clients {
+		clients += n
+	}
+	if clients > 0 {
+		slog.Info("job goes on for its other clients", "job", id, "clients", clients)
+		m.save(job)
+		return m.snapshot(job), nil
+	}
+
+	job.cancel()
+
+	// A queued job never gets to a worker
+	if job.Status == JobQueued {
+		m.dequeue(job)
+		m.finish(job, JobCanceled)
+	}
+
+	return *job, nil
+}
+
+// Stop taking new jobs and wait for the running renders to finish, the queued jobs stay in the store
+// and are rendered after the restart. When ctx is done before the renders are, they are stopped and queued
+// again as well. Their segments are already in the segment cache, so only the rest is rendered again.
+// Callbacks waiting to be tried again are kept in the store as well and sent after the restart.
+// Returns ctx's error if the renders had to be stopped.
+func (m *JobManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closing = true
+	m.ready.Broadcast()
+
+	var running = 0
+	for _, job := range m.jobs {
+		if job.Status == JobRunning {
+			running++
+		}
+	}
+	var queued = len(m.queue)
+	m.mu.Unlock()
+
+	slog.Info("waiting for running renders to finish, queued jobs are kept for the restart", "running", running, "queued", queued)
+
+	var stopped = make(chan struct{})
+	go func() {
+		m.workersDone.Wait()
+		close(stopped)
+	}()
+
+	var err error
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		err = ctx.Err()
+		slog.Warn("renders took too long, stopping them")
+
+		m.mu.Lock()
+		for _, job := range m.jobs {
+			if job.Status == JobRunning {
+				job.stopped = true
+				job.cancel()
+			}
+		}
+		m.mu.Unlock()
+
+		// ffmpeg is killed, it doesn't take long
+		<-stopped
+	}
+
+	// A callback that is being sent gets CALLBACK_TIMEOUT to be taken
+	m.notifier.Stop()
+
+	close(m.done)
+	return err
+}
+
+// True once Shutdown has been called, no new jobs are taken
+func (m *JobManager) ShuttingDown() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.closing
+}
+
+// How many jobs there are of every status
+func (m *JobManager) CountByStatus() map[JobStatus]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var counts = make(map[JobStatus]int)
+	for _, status := range []JobStatus{JobQueued, JobRunning, JobSucceeded, JobFailed, JobCanceled, JobExpired} {
+		counts[status] = 0
+	}
+	for _, job := range m.jobs {
+		counts[job.Status]++
+	}
+
+	return counts
+}
+
+// How busy the job manager is
+type JobStats struct {
+	Workers     int  `json:"workers"`
+	QueueLength int  `json:"queueLength"`
+	MaxQueue    int  `json:"maxQueue"`
+	Running     int  `json:"running"`
+	Closing     bool `json:"closing"`
+}
+
+func (m *JobManager) Stats() JobStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var stats = JobStats{Workers: m.workers, QueueLength: len(m.queue), MaxQueue: m.maxQueue, Closing: m.closing}
+
+	for _, job := range m.jobs {
+		if job.Status == JobRunning {
+			stats.Running++
+		}
+	}
+
+	return stats
+}
+
+// Closed when Shutdown is over. Requests waiting for a job that won't finish before the restart stop waiting then.
+func (m *JobManager) Done() <-chan struct{} {
+	return m.done
+}
+
+func (m *JobManager) worker() {
+	defer m.workersDone.Done()
+
+	for {
+		m.mu.Lock()
+		for len(m.queue) == 0 && !m.closing {
+			m.ready.Wait()
+		}
+
+		if m.closing {
+			m.mu.Unlock()
+			return
+		}
+
+		var job = m.queue[0]
+		m.dequeue(job)
+		m.mu.Unlock()
+
+		m.run(job)
+	}
+}
+
+// Take the job out of the queue and tell everyone behind it they moved up, must be called with the lock held
+func (m *JobManager) dequeue(job *Job) {
+	for i, queued := range m.queue {
+		if queued != job {
+			continue
+		}
+
+		m.queue = append(m.queue[:i], m.queue[i+1:]...)
+
+		for k := i; k < len(m.queue); k++ {
+			m.publish(m.queue[k].Id, Progress{Stage: "queued", QueuePosition: k + 1})
+		}
+		return
+	}
+}
+
+func (m *JobManager) run(job *Job) {
+	var skip bool
+
+	m.update(job, func(j *Job) {
+		// Canceled while it was in the queue
+		if j.Status != JobQueued {
+			skip = true
+			return
+		}
+
+		var now = time.Now()
+		j.Status = JobRunning
+		j.StartedAt = &now
+		m.save(j)
+	})
+
+	if skip {
+		return
+	}
+
+	ctx, closeLog := m.openJobLog(job.ctx, job)
+	m.update(job, func(j *Job) {
+		j.logger = logFor(ctx)
+	})
+	defer func() {
+		m.update(job, func(j *Job) {
+			j.logger = nil
+		})
+		closeLog()
+	}()
+	logFor(ctx).Info("render started", "queued", time.Since(job.CreatedAt))
+
+	workDir, err := m.renderer.makeWorkDir(job.Id)
+
+	if err == nil {
+		err = m.renderer.GenerateVideo(ctx, workDir, job.fileName, job.request, func(stage string, done float64, speed float64) {
+			var progress = renderProgress(stage, done, speed)
+
+			m.update(job, func(j *Job) {
+				j.Progress = &progress
+				m.publish(j.Id, progress)
+			})
+		})
+	}
+
+	// A render that failed after a cancel failed because of it
+	var canceled = err != nil && job.ctx.Err() != nil
+
+	// There is nothing to inspect in the work directory of a canceled render
+	if workDir != "" {
+		m.renderer.cleanupWorkDir(ctx, workDir, err != nil && !canceled)
+	}
+
+	// Never leave a half written video behind where the cache would find it
+	if err != nil {
+		if err := os.Remove(m.renderer.outputPath(job.fileName)); err != nil && !os.IsNotExist(err) {
+			logFor(ctx).Error("removing partial video", "error", err)
+		}
+	}
+
+	// Let go of the context, the render is over
+	job.cancel()
+
+	m.update(job, func(j *Job) {
+		// Stopped by a shutdown, it starts over after the restart
+		if canceled && j.stopped {
+			logFor(ctx).Warn("stopped by shutdown, queued again")
+			j.Status = JobQueued
+			j.StartedAt = nil
+			j.Progress = nil
+			m.save(j)
+			return
+		}
+
+		if !canceled {
+			m.recordRenderTime(time.Since(*j.StartedAt))
+		}
+
+		if canceled {
+			m.finish(j, JobCanceled)
+			return
+		}
+
+		if err != nil {
+			// The client only gets what errorBodyFrom lets out, the paths and ffmpeg's output go in the log
+			logFor(ctx).Error("render failed", "error", err)
+			var body = errorBodyFrom(err)
+			j.Error = &body
+			m.finish(j, JobFailed)
+		} else {
+			j.Progress = &Progress{Stage: "done", Percent: 100, StagePercent: 100}
+			// URL for downloading the file, for use in front-end
+			j.URL = m.publicURL + j.fileName + "-final.mp4"
+
+			if info, err := os.Stat(m.renderer.outputPath(j.fileName)); err == nil {
+				j.outputSize = info.Size()
+				outputBytes.Add(float64(j.outputSize))
+			}
+			var now = time.Now()
+			j.LastUsedAt = &now
+
+			m.finish(j, JobSucceeded)
+			m.sweepCache()
+		}
+	})
+}
+
+// Mark the job as finished and let the subscribers know there is nothing more to wait for.
+// Must be called with the lock held.
+func (m *JobManager) finish(j *Job, status JobStatus) {
+	var now = time.Now()
+	j.Status = status
+	j.FinishedAt = &now
+
+	var logger = j.logger
+	if logger == nil {
+		logger = slog.With("job", j.Id)
+	}
+	if j.Error != nil {
+		logger.Warn("job finished", "status", status, "error", j.Error.Error)
+	} else {
+		logger.Info("job finished", "status", status)
+	}
+
+	jobsFinished.WithLabelValues(string(status)).Inc()
+	m.save(j)
+
+	// Only a succeeded job has a video for others to use
+	if status != JobSucceeded {
+		m.uncache(j)
+	}
+
+	for _, ch := range m.subscribers[j.Id] {
+		close(ch)
+	}
+	delete(m.subscribers, j.Id)
+
+	m.notify(j)
+}
+
+// Keep a moving average of how long renders take, for RetryAfter. Must be called with the lock held.
+func (m *JobManager) recordRenderTime(d time.Duration) {
+	m.renderTime = (m.renderTime*4 + d) / 5
+}
+
+// Write the job to the store, must be called with the lock held.
+// The job carries on if it can't be written, it's only lost if the server restarts.
+func (m *JobManager) save(j *Job) {
+	if err := m.store.Save(j); err != nil {
+		slog.Error("saving job", "job", j.Id, "error", err)
+	}
+}
+
+// Forget the jobs that finished more than jobMaxAge ago and whose video isn't cached anymore,
+// with their Idempotency-Keys and logs, and the render counts of the days before today.
+// Must be called with the lock held.
+func (m *JobManager) sweepJobs() {
+	for id, job := range m.jobs {
+		if !job.finished() || job.FinishedAt == nil || time.Since(*job.FinishedAt) <= m.jobMaxAge || m.byHash[job.hash] == job {
+			continue
+		}
+
+		if err := m.store.Delete(id); err != nil {
+			slog.Error("removing job", "job", id, "error", err)
+			continue
+		}
+		delete(m.jobs, id)
+
+		for key, rec := range m.keys {
+			if rec.JobId != id {
+				continue
+			}
+
+			delete(m.keys, key)
+			if err := m.store.DeleteKey(key); err != nil {
+				slog.Error("removing idempotency key", "job", id, "error", err)
+			}
+		}
+
+		if err := os.Remove(m.jobLogPath(id)); err != nil && !os.IsNotExist(err) {
+			slog.Error("removing job log", "job", id, "error", err)
+		}
+	}
+
+	if err := m.store.DeleteUsageBefore(today()); err != nil {
+		slog.Error("removing old API key usage", "error", err)
+	}
+}
+
+// Send progress to everyone following the job, must be called with the lock held.
+// A subscriber that doesn't keep up misses updates rather than holding up the render.
+func (m *JobManager) publish(id string, progress Progress) {
+	for _, ch := range m.subscribers[id] {
+		select {
+		case ch <- progress:
+		default:
+		}
+	}
+}
+
+// Change a job while holding the lock, so readers never see a half updated job
+func (m *JobManager) update(job *Job, fn func(j *Job)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fn(job)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"server/branding"
+)
+
+// A JobManager without workers, so every job stays queued until it's canceled
+func newTestJobManager(t *testing.T) *JobManager {
+	t.Helper()
+
+	store, err := OpenJobStore(filepath.Join(t.TempDir(), JOB_DB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	var cfg = DefaultConfig()
+	cfg.Workers = 0
+	cfg.LogDir = t.TempDir()
+
+	jobs, err := NewJobManager(&Renderer{Templates: &branding.Registry{}}, store, NewNotifier("", "", false), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return jobs
+}
+
+// A client waiting with ?wait=true whose connection drops has its job canceled, sending the request again
+// with the same Idempotency-Key must render it again rather than replay the canceled job
+func TestSubmitAfterDisconnectRendersAgain(t *testing.T) {
+	var jobs = newTestJobManager(t)
+	var request = JSONObj{Template: "test"}
+
+	first, replayed, err := jobs.Submit(request, "key", "", nil)
+	if err != nil || replayed {
+		t.Fatalf("first submit: replayed %v, error %v", replayed, err)
+	}
+
+	// What waitForJob does when the client goes away
+	canceled, err := jobs.Cancel(first.Id, "")
+	if err != nil || canceled.Status != JobCanceled {
+		t.Fatalf("cancel: status %s, error %v", canceled.Status, err)
+	}
+
+	retry, replayed, err := jobs.Submit(request, "key", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed || retry.Id == first.Id {
+		t.Fatalf("retry replayed the canceled job %s", first.Id)
+	}
+	if retry.Status != JobQueued {
+		t.Fatalf("retry: status %s, want %s", retry.Status, JobQueued)
+	}
+
+	// The key is now the retry's, so sending it once more replays that job
+	again, replayed, err := jobs.Submit(request, "key", "", nil)
+	if err != nil || !replayed || again.Id != retry.Id {
+		t.Fatalf("second retry: job %s, replayed %v, error %v, want %s replayed", again.Id, replayed, err, retry.Id)
+	}
+}
+
+// Sending a submit again with the same Idempotency-Key is a retry of the same client, not another one,
+// so a single cancel still stops the job
+func TestReplayThenCancelStopsJob(t *testing.T) {
+	var jobs = newTestJobManager(t)
+	var request = JSONObj{Template: "test"}
+
+	first, _, err := jobs.Submit(request, "key", "owner", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retry, replayed, err := jobs.Submit(request, "key", "owner", nil)
+	if err != nil || !replayed || retry.Id != first.Id {
+		t.Fatalf("retry: job %s, replayed %v, error %v, want %s replayed", retry.Id, replayed, err, first.Id)
+	}
+
+	canceled, err := jobs.Cancel(first.Id, "owner")
+	if err != nil || canceled.Status != JobCanceled {
+		t.Fatalf("cancel: status %s, error %v, want %s", canceled.Status, err, JobCanceled)
+	}
+}
+
+// Only the API key that submitted a job can see and cancel it
+func TestJobOnlyVisibleToOwner(t *testing.T) {
+	var jobs = newTestJobManager(t)
+
+	job, _, err := jobs.Submit(JSONObj{Template: "test"}, "", "owner", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := jobs.Get(job.Id, "other"); ok {
+		t.Error("another key can get the job")
+	}
+	if _, ok := jobs.LogPath(job.Id, "other"); ok {
+		t.Error("another key can get the log of the job")
+	}
+	if _, err := jobs.Cancel(job.Id, "other"); err != ErrJobNotFound {
+		t.Errorf("another key canceling the job: error %v, want %v", err, ErrJobNotFound)
+	}
+
+	if _, ok := jobs.Get(job.Id, "owner"); !ok {
+		t.Error("the owner can't get the job")
+	}
+	if canceled, err := jobs.Cancel(job.Id, "owner"); err != nil || canceled.Status != JobCanceled {
+		t.Errorf("the owner canceling the job: status %s, error %v, want %s", canceled.Status, err, JobCanceled)
+	}
+}
+
+// Only the logs of jobs that are gone are swept, a job that is kept keeps its log however old it is
+func TestSweepJobLogsKeepsLogsOfKnownJobs(t *testing.T) {
+	var jobs = newTestJobManager(t)
+
+	job, _, err := jobs.Submit(JSONObj{Template: "test"}, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var old = time.Now().Add(-2 * jobs.jobMaxAge)
+	var kept = jobs.jobLogPath(job.Id)
+	var gone = jobs.jobLogPath("gone")
+	for _, path := range []string{kept, gone} {
+		if err := os.WriteFile(path, []byte("log"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jobs.mu.Lock()
+	jobs.sweepJobLogs()
+	jobs.mu.Unlock()
+
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("the log of the job was removed: %v", err)
+	}
+	if _, err := os.Stat(gone); !os.IsNotExist(err) {
+		t.Errorf("the log of the gone job is still there: %v", err)
+	}
+}
+
+// With a full queue Submit turns jobs away, and RetryAfter is how long the workers take to make room
+func TestSubmitQueueFull(t *testing.T) {
+	var jobs = newTestJobManager(t)
+	jobs.maxQueue = 2
+	jobs.workers = 2
+	jobs.renderTime = 30 * time.Second
+
+	for i := 0; i < 2; i++ {
+		job, _, err := jobs.Submit(JSONObj{Template: "test-" + strconv.Itoa(i)}, "", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.QueuePosition != i+1 {
+			t.Errorf("job %d is number %d in the queue", i+1, job.QueuePosition)
+		}
+	}
+
+	if _, _, err := jobs.Submit(JSONObj{Template: "test-full"}, "", "", nil); err != ErrQueueFull {
+		t.Fatalf("submit to a full queue: error %v, want %v", err, ErrQueueFull)
+	}
+
+	// Nothing is charged for a job that isn't queued
+	var charged bool
+	jobs.Submit(JSONObj{Template: "test-full"}, "", "", func() error {
+		charged = true
+		return nil
+	})
+	if charged {
+		t.Error("a job turned away was charged")
+	}
+
+	if wait := jobs.RetryAfter(); wait != 30*time.Second {
+		t.Errorf("retry after %s with a full queue, want one render of 30s", wait)
+	}
+
+	// Jobs queued again after a restart can go over the limit, the workers need more rounds for those
+	jobs.mu.Lock()
+	jobs.queue = append(jobs.queue, jobs.queue[0], jobs.queue[0], jobs.queue[0])
+	jobs.mu.Unlock()
+	if wait := jobs.RetryAfter(); wait != time.Minute {
+		t.Errorf("retry after %s with 3 jobs over the limit, want two renders of 30s", wait)
+	}
+}
+
+// The API answers a full queue with 429 and when to try again
+func TestRenderQueueFull(t *testing.T) {
+	var renderer = newTestRenderer(t, map[string]float64{"Heart_Long": 60, "heart/lead": 2})
+	var jobs = newTestJobManager(t)
+	jobs.maxQueue = 1
+	jobs.workers = 1
+	jobs.renderTime = 90 * time.Second
+
+	auth, err := NewAuth(false, nil, jobs.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mux = http.NewServeMux()
+	handleAPICall(mux, jobs, renderer, auth)
+
+	var submit = func(name string) *httptest.ResponseRecorder {
+		var body = `{"payload":[{"id":"Heart","parentOptions":[{"name":"` + name + `","audioName":"heart/lead"}]}]}`
+		var w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api", strings.NewReader(body)))
+		return w
+	}
+
+	if w := submit("first"); w.Code != http.StatusAccepted {
+		t.Fatalf("first render: status %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	var w = submit("second")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "90" {
+		t.Errorf("render with a full queue: status %d, Retry-After %q, want %d and 90", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+}
+
+// A render that is still running when the shutdown deadline is up is stopped and queued again,
+// and the job manager of the restart renders it from the start
+func TestShutdownRequeuesStoppedRender(t *testing.T) {
+	// An ffmpeg that never finishes on its own
+	var bin = t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	var renderer = newTestRenderer(t, map[string]float64{"Heart_Long": 60, "heart/lead": 2})
+	renderer.OutputDir = t.TempDir()
+	renderer.WorkDir = t.TempDir()
+
+	var path = filepath.Join(t.TempDir(), JOB_DB)
+	store, err := OpenJobStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg = DefaultConfig()
+	cfg.Workers = 1
+	cfg.LogDir = t.TempDir()
+
+	jobs, err := NewJobManager(renderer, store, NewNotifier("", "", false), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var request = JSONObj{Payload: []VideoObj{{Id: "Heart", ParentOptions: []ParentOption{{Name: "Hjertebanken", AudioName: "heart/lead"}}}}}
+	job, _, err := jobs.Submit(request, "", "owner", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if current, _ := jobs.Get(job.Id, "owner"); current.Status == JobRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the job never started")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := jobs.Shutdown(ctx); err != context.Canceled {
+		t.Errorf("shutdown past its deadline: error %v, want %v", err, context.Canceled)
+	}
+
+	if stopped, _ := jobs.Get(job.Id, "owner"); stopped.Status != JobQueued || stopped.StartedAt != nil || stopped.Progress != nil {
+		t.Errorf("stopped job: status %s, started %v, progress %v, want queued from the start", stopped.Status, stopped.StartedAt, stopped.Progress)
+	}
+
+	// The restart
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = OpenJobStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	cfg.Workers = 0
+	restarted, err := NewJobManager(renderer, store, NewNotifier("", "", false), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requeued, ok := restarted.Get(job.Id, "owner")
+	if !ok || requeued.Status != JobQueued || requeued.QueuePosition != 1 {
+		t.Errorf("after the restart: found %v, status %s, queue position %d, want queued first in line", ok, requeued.Status, requeued.QueuePosition)
+	}
+}
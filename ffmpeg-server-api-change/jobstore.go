@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Every job is kept in here, so they survive a restart of the server
+const JOB_DB = "jobs.db"
+
+var jobsBucket = []byte("jobs")
+var keysBucket = []byte("idempotency")
+var usageBucket = []byte("usage")
+
+// JobStore keeps jobs in a bbolt database, one JSON record per job keyed by its id,
+// the Idempotency-Keys with the job each was used for, and how many renders every API key asked for today
+type JobStore struct {
+	db *bolt.DB
+}
+
+// A job as it is stored, with the request and where the video goes
+type storedJob struct {
+	Job
+	FileName    string   `json:"fileName"`
+	Request     JSONObj  `json:"request"`
+	Hash        string   `json:"hash,omitempty"`
+	OutputSize  int64    `json:"outputSize,omitempty"`
+	Callbacks   []string `json:"callbacks,omitempty"`
+	Undelivered []string `json:"undelivered,omitempty"` // Callbacks to send again after a restart
+
+	Clients map[string]int `json:"clients,omitempty"` // Per id of the API key that submitted it
+}
+
+// Open the job database at path, it's made if it doesn't exist
+func OpenJobStore(path string) (*JobStore, error) {
+	// Only one server can have the database open, don't wait forever for another one to let go
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{jobsBucket, keysBucket, usageBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &JobStore{db: db}, nil
+}
+
+// Write the job, replacing what was stored for it before
+func (s *JobStore) Save(job *Job) error {
+	data, err := json.Marshal(storedJob{Job: *job, FileName: job.fileName, Request: job.request, Hash: job.hash, OutputSize: job.outputSize, Callbacks: job.callbacks, Undelivered: job.undelivered, Clients: job.clients})
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(job.Id), data)
+	})
+}
+
+// Read every stored job
+func (s *JobStore) Load() ([]*Job, error) {
+	var jobs []*Job
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(id, data []byte) error {
+			var stored storedJob
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return err
+			}
+
+			var job = stored.Job
+			job.fileName = stored.FileName
+			job.request = stored.Request
+			job.hash = stored.Hash
+			job.outputSize = stored.OutputSize
+			job.callbacks = stored.Callbacks
+			job.undelivered = stored.Undelivered
+			job.clients = stored.Clients
+
+			jobs = append(jobs, &job)
+			return nil
+		})
+	})
+
+	return jobs, err
+}
+
+// Forget the job, for when it's so old nobody asks for it anymore
+func (s *JobStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Delete([]byte(id))
+	})
+}
+
+// Write the job an Idempotency-Key was used for
+func (s *JobStore) SaveKey(key string, rec idempotencyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).Put([]byte(key), data)
+	})
+}
+
+func (s *JobStore) DeleteKey(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).Delete([]byte(key))
+	})
+}
+
+// Read every stored Idempotency-Key
+func (s *JobStore) LoadKeys() (map[string]idempotencyRecord, error) {
+	var keys = make(map[string]idempotencyRecord)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).ForEach(func(key, data []byte) error {
+			var rec idempotencyRecord
+			if err := json.Unmarshal(data, &rec); err != nil {
+				return err
+			}
+
+			keys[string(key)] = rec
+			return nil
+		})
+	})
+
+	return keys, err
+}
+
+// Write how many renders the API key with the id asked for on the day
+func (s *JobStore) SaveUsage(id string, day string, renders int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usageBucket).Put([]byte(day+"/"+id), []byte(strconv.Itoa(renders)))
+	})
+}
+
+// Read how many renders every API key asked for on the day, per key id
+func (s *JobStore) LoadUsage(day string) (map[string]int, error) {
+	var usage = make(map[string]int)
+	var prefix = []byte(day + "/")
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var c = tx.Bucket(usageBucket).Cursor()
+
+		for key, data := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, data = c.Next() {
+			renders, err := strconv.Atoi(string(data))
+			if err != nil {
+				return err
+			}
+
+			usage[string(key[len(prefix):])] = renders
+		}
+		return nil
+	})
+
+	return usage, err
+}
+
+// Forget how many renders the API keys asked for on the days before day
+func (s *JobStore) DeleteUsageBefore(day string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var c = tx.Bucket(usageBucket).Cursor()
+
+		// The keys start with the day, so the old days come first
+		for key, _ := c.First(); key != nil && string(key) < day; key, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *JobStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// How much is logged and how, unless configured otherwise. The format is text or json.
+const LOG_LEVEL = "info"
+const LOG_FORMAT = "text"
+
+// Every render logs to a file of its own in here, with everything ffmpeg said. Served on /api/jobs/{id}/log.
+const JOB_LOG_DIR = "logs/jobs"
+
+// Set the default logger to write at level and up in format to stderr
+func setupLogging(level string, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+
+	var options = &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	default:
+		return fmt.Errorf("unknown log format %q, must be text or json", format)
+	}
+
+	return nil
+}
+
+type loggerKey struct{}
+type jobLogKey struct{}
+
+// The context with a logger that adds its attributes to every line, like the job or request id
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// The logger of the context, the default logger if it has none
+func logFor(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// The context with the log file of a job, where ffmpeg's output goes
+func withJobLog(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, jobLogKey{}, w)
+}
+
+// The log file of the job the context belongs to, nothing is kept if it has none
+func jobLogFor(ctx context.Context) io.Writer {
+	if w, ok := ctx.Value(jobLogKey{}).(io.Writer); ok {
+		return w
+	}
+	return io.Discard
+}
+
+// A writer that more goroutines can write to, every write stays in one piece
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Write(p)
+}
+
+// Sends every record to all its handlers that want it
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	for _, h := range t {
+		if !h.Enabled(ctx, record.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, record.Clone()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var handlers = make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	var handlers = make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+// Where the log of the job is kept
+func (m *JobManager) jobLogPath(id string) string {
+	return filepath.Join(m.logDir, id+".log")
+}
+
+// Where the log of the job is kept, if there is such a job and the owner may see it
+func (m *JobManager) LogPath(id string, owner string) (string, bool) {
+	if _, ok := m.Get(id, owner); !ok {
+		return "", false
+	}
+	return m.jobLogPath(id), true
+}
+
+// Open the log file of the job, and make a context whose logger writes to both the server log and the file.
+// Everything is kept in the file, whatever the level of the server log. Call the returned function when the job is done.
+func (m *JobManager) openJobLog(ctx context.Context, job *Job) (context.Context, func()) {
+	var logger = slog.Default().With("job", job.Id)
+
+	file, err := os.OpenFile(m.jobLogPath(job.Id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logger.Error("opening job log", "error", err)
+		return withLogger(ctx, logger), func() {}
+	}
+
+	var w = &lockedWriter{w: file}
+	var fileHandler = slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+	logger = slog.New(teeHandler{slog.Default().Handler(), fileHandler}).With("job", job.Id)
+
+	return withJobLog(withLogger(ctx, logger), w), func() { file.Close() }
+}
+
+// Remove the logs of jobs that are gone, left behind when removing them with their job failed or the job database
+// was replaced. The logs of known jobs go with their job, see sweepJobs. Must be called with the lock held.
+func (m *JobManager) sweepJobLogs() {
+	entries, err := os.ReadDir(m.logDir)
+	if err != nil {
+		slog.Error("reading job logs", "error", err)
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() || !strings.HasSuffix(info.Name(), ".log") {
+			continue
+		}
+
+		if _, ok := m.jobs[strings.TrimSuffix(info.Name(), ".log")]; ok || time.Since(info.ModTime()) <= m.jobMaxAge {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(m.logDir, info.Name())); err != nil {
+			slog.Error("removing job log", "error", err)
+		}
+	}
+}
+
+// Give every request an id, from the X-Request-Id header if the client or a proxy sent one,
+// and log every request with it once it's answered
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var id = r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 128 {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-Id", id)
+
+		var logger = slog.Default().With("request", id)
+		var recorder = &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		var start = time.Now()
+
+		next.ServeHTTP(recorder, r.WithContext(withLogger(r.Context(), logger)))
+
+		logger.Info("request", "method", r.Method, "path", r.URL.Path, "status", recorder.status, "duration", time.Since(start))
+	})
+}
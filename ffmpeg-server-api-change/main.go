@@ -1,67 +1,68 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log"
+	"math"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 
 	ffmpeg "nrt/ffmpeg"
 	omniglyph "nrt/omniglyph"
+	"server/branding"
+	"server/catalog"
+	"server/probe"
 )
 
-// FFMPEG Video stiching command
-var FFMPEG_COMMAND = "ffmpeg -f concat -safe 0 -i vFile.txt -c copy videos/output/"
-
-// FFMPEG Top-right text logo
-var LOGO = `drawtext="fontfile=./fonts/TitilliumWeb-SemiBold.ttf:text='MIT HJERTE':x=w-tw-15:y=15:fontsize=48:fontcolor=#B40031"`
-
-// FFMPEG Intro text in the center of the screen for the first 5 seconds
-var INTRO_TEXT = `drawtext="fontfile=./fonts/TitilliumWeb-SemiBold.ttf:text='MIT HJERTE':x=(w-text_w)/2:y=(h-text_h)/2:fontsize=96:fontcolor=#B40031:enable='between(t,0,5)'"`
-
-// FFMPEG Outro disclaimer in the center of the screen for the last 5 seconds
-var OUTRO_DISCLAIMER_TEXT = `drawtext="fontfile=./fonts/TitilliumWeb-SemiBold.ttf:text='De medicinske/sundhedsmæssige oplysninger gives kun til generelle informations- og uddannelsesformål og er ikke en erstatning for professionel rådgivning. Derfor opfordrer vi dig til at rådføre dig med de relevante fagfolk, før du tager nogen handlinger baseret på sådanne oplysninger. Vi yder ingen form for medicinsk eller sundhedsmæssig rådgivning. Brugen af eller tilliden til enhver information i denne video er på eget ansvar.':x=(w-text_w)/2:y=(h-text_h)/2:fontsize=32:fontcolor=#B40031`
-
-// Generate outro text between, it takes the full dureatoin
-func GenerateOutroFromDur(duration float64) string {
-	return `:enable='between(t,` + strconv.FormatFloat(duration-5, 'f', 2, 64) + `,` + strconv.FormatFloat(duration, 'f', 2, 64) + `)'` + `"`
-}
-
 // Textfile generation function for each Parent option in VideoStruct, and each its sub Options.
 // It creates two files, one for the title and one for the text.
-// Takes choice.name as title, and subOption.name as text.
-// It returns the filename
-func GenerateTextFile(parentOpt ParentOption) string {
+// Takes choice.name as title, and subOption.name as text, wrapped as the template says.
+// The files are made in dir, and it returns the path of the files without the -title/-text suffix
+func GenerateTextFile(dir string, parentOpt ParentOption, tpl *branding.Template) (string, error) {
 	// Create a new UUID
 	UUID := uuid.New()
+	var textPath = filepath.Join(dir, UUID.String())
 
 	// Create a file for title and text
-	titleFile, _ := os.Create("text/" + UUID.String() + "-title.txt")
-	textFile, _ := os.Create("text/" + UUID.String() + "-text.txt")
+	titleFile, err := os.Create(textPath + "-title.txt")
+	if err != nil {
+		return "", &TextFileError{Path: textPath + "-title.txt", Err: err}
+	}
+	defer titleFile.Close()
+
+	textFile, err := os.Create(textPath + "-text.txt")
+	if err != nil {
+		return "", &TextFileError{Path: textPath + "-text.txt", Err: err}
+	}
+	defer textFile.Close()
 
 	var titleWrapper = omniglyph.WordWrapper{
 		Joiner:    " ",
 		NewLine:   "\n",
 		Separator: " ",
 		Text:      parentOpt.Name,
-		Width:     120,
+		Width:     tpl.Title.Wrap,
 	}
 	var textWrapper = omniglyph.WordWrapper{
 		Joiner:    " ",
 		NewLine:   "\n",
 		Separator: " ",
-		Width:     60,
+		Width:     tpl.Text.Wrap,
 
-		IndentAmount: 5,
+		IndentAmount: tpl.Text.Indent,
 		IndentAll:    true,
 		IndentStart:  false,
 		IndentGlyph:  " ",
 
-		Prefix:      "  • ",
+		Prefix:      tpl.Text.Prefix,
 		PrefixStart: true,
 	}
 
@@ -69,438 +70,406 @@ func GenerateTextFile(parentOpt ParentOption) string {
 	var replaceWith = []string{"\\%"}
 
 	titleWrapper.ReplaceGlyphs(replace, replaceWith)
-	titleFile.WriteString(titleWrapper.Text)
+	if tpl.Title.Wrap > 0 {
+		titleWrapper.Wrap()
+	}
+	if _, err := titleFile.WriteString(titleWrapper.Text); err != nil {
+		return "", &TextFileError{Path: titleFile.Name(), Err: err}
+	}
 
 	for _, option := range parentOpt.Options {
 		if option.Active {
 			// fmt.Println("Checked:", option.Name) // Debugging
 			textWrapper.Text = option.Name
 			textWrapper.ReplaceGlyphs(replace, replaceWith)
-			textWrapper.Wrap()
-			textFile.WriteString(textWrapper.Text + textWrapper.NewLine)
+			if tpl.Text.Wrap > 0 {
+				textWrapper.Wrap()
+			}
+			if _, err := textFile.WriteString(textWrapper.Text + textWrapper.NewLine); err != nil {
+				return "", &TextFileError{Path: textFile.Name(), Err: err}
+			}
 		}
 	}
 
-	titleFile.Close()
-	textFile.Close()
-
-	return UUID.String()
+	return textPath, nil
 }
 
 // UNUSED allows unused variables to be included in Go programs
 func UNUSED(x ...interface{}) {}
 
-// Main video generation function
-func GenerateVideo(fileName string, videoChoiceArr []VideoObj) {
-	var optArrText []SanitizedOption
-	var optArrAudio []ffmpeg.FFMPEGAudio
+// Write one of the template's fixed texts to a file in dir, so it doesn't need escaping in the filter graph
+// Returns the path of the file
+func GenerateBlockFile(dir string, name string, block branding.TextBlock) (string, error) {
+	var path = filepath.Join(dir, name+".txt")
 
-	// Cleanup
-	removeVFileErr := os.Remove("vFile.txt")
-	removeAFileErr := os.Remove("aFile.txt")
-
-	if removeVFileErr != nil {
-		fmt.Println("vFile.txt does not exist, proceeding to create it")
-	}
-	if removeAFileErr != nil {
-		fmt.Println("aFile.txt does not exist, proceeding to create it")
+	var wrapper = omniglyph.WordWrapper{
+		Joiner:    " ",
+		NewLine:   "\n",
+		Separator: " ",
+		Text:      block.Text,
+		Width:     block.Style.Wrap,
 	}
 
-	vFile, createVFileErr := os.Create("vFile.txt")
-	aFile, createAFileErr := os.Create("aFile.txt")
-
-	if createVFileErr != nil {
-		panic("Error creating vFile.txt")
+	wrapper.ReplaceGlyphs([]string{"%"}, []string{"\\%"})
+	if block.Style.Wrap > 0 {
+		wrapper.Wrap()
 	}
-	if createAFileErr != nil {
-		panic("Error creating aFile.txt")
-	}
-
-	var videoName string
-	var totalDuration float64 = 10 // 10 seconds extra for intro and outro
-
-	// Loop through each video choice and make data array for both text and audio
-	for _, v := range videoChoiceArr {
-		fmt.Println("Video:", v.Id) // Debugging
-		videoName += v.Id + "_Long" // Set video name
 
-		for idx, parentOpt := range v.ParentOptions {
-			var parentOptDur float64 = 0
-
-			// If first parent option, consider intro text duration
-
-			var audioFileName = "audio/" + parentOpt.AudioName + ".aac"
-
-			// Use an introduction if defined
-			if parentOpt.Introduction != "" {
-
-				var audioDur, err = getDurationInSeconds("audio/" + parentOpt.Introduction + ".aac")
-				if err != nil {
-					fmt.Println("Error getting duration of audio file:", "audio/"+parentOpt.Introduction+".aac")
-				}
-
-				parentOptDur += audioDur
-
-				fmt.Println("Parent option duration:", parentOptDur) // Debugging
-
-				var introTextWrapper = omniglyph.WordWrapper{
-					Joiner:    " ",
-					NewLine:   "\n",
-					Separator: " ",
-					Text:      parentOpt.Description,
-					Width:     60,
-
-					IndentAmount: 5,
-					IndentAll:    true,
-					IndentStart:  false,
-					IndentGlyph:  " ",
-				}
-
-				var replace = []string{"%"}
-				var replaceWith = []string{"\\%"}
-
-				introTextWrapper.ReplaceGlyphs(replace, replaceWith)
-				introTextWrapper.Wrap()
-
-				// Create a file for the intro text
-				introTextFile, _ := os.Create("text/" + parentOpt.AudioName + "-intro.txt")
-				introTextFile.WriteString(introTextWrapper.Text)
-				introTextFile.Close()
-
-				aFile.WriteString("file 'audio/" + parentOpt.Introduction + ".aac'" + "\n")
+	if err := os.WriteFile(path, []byte(wrapper.Text), 0644); err != nil {
+		return "", &TextFileError{Path: path, Err: err}
+	}
 
-				optArrAudio = append(optArrAudio, ffmpeg.FFMPEGAudio{
-					Duration: audioDur,
-					Delay:    0.250,
-					FileType: "aac",
-					Input:    "audio/" + parentOpt.Introduction,
-				})
-			} else if parentOpt.AudioName != "" {
-				// get duration of audio file
-				var audioDur, err = getDurationInSeconds(audioFileName)
-				if err != nil {
-					fmt.Println("Error getting duration of audio file:", audioFileName)
-				}
+	return path, nil
+}
 
-				parentOptDur += audioDur + 0.250 // Add 250ms delay
+// Renderer holds what every render shares: the assets it can use, the cached prober and the branding templates
+type Renderer struct {
+	Assets         *catalog.Catalog
+	Prober         *probe.Prober
+	Templates      *branding.Registry
+	StageTimeouts  map[string]time.Duration // How long each render stage may take, stages not listed have no limit
+	OutputDir      string                   // Where the finished videos are written
+	WorkDir        string                   // Every render gets a scratch directory in here
+	SegmentDir     string                   // Render a segment at a time and keep them here, or in a single pass if empty
+	SegmentWorkers int                      // Segments encoded at the same time, 0 is one per CPU
+
+	SegmentCacheMaxBytes int64  // The least recently used segments are removed when they take up more than this
+	Preset               string // x264 preset and quality of both render paths
+	CRF                  int
+	KeepFailedWorkDirs   bool // Keep the scratch directory of failed renders, so the files ffmpeg choked on can be inspected
+}
 
-				fmt.Println("Parent option duration:", parentOptDur) // Debugging
+// How long each render stage may take before ffmpeg is killed, a hung ffmpeg would otherwise hold a worker forever
+var DEFAULT_STAGE_TIMEOUTS = map[string]time.Duration{
+	"audio stitch": 2 * time.Minute,
+	"trim":         2 * time.Minute,
+	"combine":      2 * time.Minute,
+	"final encode": 30 * time.Minute,
+	"segment":      10 * time.Minute,
+	"concat":       2 * time.Minute,
+}
 
-				aFile.WriteString("file 'audio/" + parentOpt.AudioName + ".aac'" + "\n")
+// Run a render stage with its timeout. Returns a StageTimeoutError if it took too long.
+func (r *Renderer) runStage(ctx context.Context, stage string, cmd *ffmpeg.FFMPEGCommand, duration float64, progress ProgressFunc) error {
+	var start = time.Now()
 
-				optArrAudio = append(optArrAudio, ffmpeg.FFMPEGAudio{
-					Duration: audioDur,
-					Delay:    0.250,
-					FileType: "aac",
-					Input:    "audio/" + parentOpt.AudioName,
-				})
-			}
+	var timeout = r.StageTimeouts[stage]
+	if timeout <= 0 {
+		err := runFFMPEG(ctx, stage, cmd, duration, progress)
+		observeStage(stage, time.Since(start), duration, err)
+		logStage(ctx, stage, time.Since(start), err)
+		return err
+	}
 
-			// Add each sub option's audio if it's defined
-			for _, option := range parentOpt.Options {
-				if option.Active {
+	stageCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-					var audioDur, err = getDurationInSeconds("audio/" + option.AudioName + ".aac")
+	err := runFFMPEG(stageCtx, stage, cmd, duration, progress)
+	observeStage(stage, time.Since(start), duration, err)
+	logStage(ctx, stage, time.Since(start), err)
 
-					if err != nil {
-						fmt.Println("Error getting duration of audio file:", "audio/"+option.AudioName+".aac")
-					}
+	// Only the stage ran out of time, not the whole render
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return &StageTimeoutError{Stage: stage, Timeout: timeout}
+	}
 
-					//	totalDurationMs += audioDur * 1000
-					parentOptDur += audioDur + option.Delay
+	return err
+}
 
-					fmt.Println("Option duration:", audioDur) // Debugging
+// Log how long the stage took, with the job id of the context
+func logStage(ctx context.Context, stage string, took time.Duration, err error) {
+	if err != nil {
+		logFor(ctx).Error("stage failed", "stage", stage, "duration", took, "error", err)
+		return
+	}
+	logFor(ctx).Info("stage done", "stage", stage, "duration", took)
+}
 
-					aFile.WriteString("file 'audio/" + option.AudioName + ".aac'" + "\n")
+// Find the template by name, an empty name is the default template
+func (r *Renderer) template(name string) (*branding.Template, bool) {
+	if name == "" {
+		name = DEFAULT_TEMPLATE
+	}
 
-					optArrAudio = append(optArrAudio, ffmpeg.FFMPEGAudio{
-						Duration: audioDur,
-						Delay:    option.Delay,
-						FileType: "aac",
-						Input:    "audio/" + option.AudioName,
-					})
-				}
-			}
+	return r.Templates.Get(name)
+}
 
-			// Audioname depends on whether or not there is an introduction
-			var audioName string
-			if parentOpt.Introduction != "" {
-				audioName = parentOpt.Introduction
-			} else {
-				audioName = parentOpt.AudioName
-			}
+// Main video generation function
+// All the intermediate files (text files, audio and video) are made in workDir,
+// so renders running at the same time never touch each other's files.
+// Only the final video is written to OutputDir.
+// With a SegmentDir the video is rendered a segment at a time and the segments are cached, see generateSegmented.
+// Video and audio names are resolved against the asset catalog, and every timing comes from the timeline.
+// The logo, intro, outro and text styles come from the template the request asks for.
+// progress is called while ffmpeg works through each stage, it may be nil.
+// Canceling ctx kills the running ffmpeg and returns the context's error.
+// Returns a MissingAssetError, ProbeError, TextFileError or FFMPEGError if any step fails
+func (r *Renderer) GenerateVideo(ctx context.Context, workDir string, fileName string, request JSONObj, progress ProgressFunc) error {
+	if len(request.Payload) != 1 {
+		return fmt.Errorf("expected exactly one video, got %d", len(request.Payload))
+	}
 
-			optArrText = append(optArrText, SanitizedOption{
-				Id:        idx,
-				Text:      GenerateTextFile(parentOpt), // Generate a textfile for each option's title & text
-				AudioName: audioName,
-				Duration:  parentOptDur, // In seconds
-				Delay:     0.250,
-			})
+	tpl, ok := r.template(request.Template)
+	if !ok {
+		return fmt.Errorf("unknown template %q", request.Template)
+	}
 
-			totalDuration += parentOptDur
-			fmt.Println("Total duration:", totalDuration) // Debugging
-		}
+	var v = request.Payload[0]
+	logFor(ctx).Info("rendering video", "video", v.Id, "template", tpl.Name)
 
+	timeline, err := r.BuildTimeline(ctx, v, tpl)
+	if err != nil {
+		return err
 	}
 
-	vFile.Close()
-	aFile.Close()
+	logFor(ctx).Debug("timeline built", "duration", timeline.Duration, "sections", len(timeline.Sections))
 
-	var workingDir, err = os.Getwd()
-	var audioFileName = StitchAudio(workingDir + "/" + aFile.Name())
+	// Generate a textfile for each option's title & text
+	var textPaths []string
+	for _, section := range timeline.Sections {
+		textPath, err := GenerateTextFile(workDir, section.Option, tpl)
+		if err != nil {
+			return err
+		}
 
-	if err != nil {
-		fmt.Println(err)
+		textPaths = append(textPaths, textPath)
 	}
 
-	// Get duration of video
-	cmd := exec.Command("ffprobe", "-v", "error",
-		"-show_entries", "format=duration",
-		"-of", "default=noprint_wrappers=1:nokey=1",
-		"videos/"+videoName+".mp4")
-	output, durErr := cmd.Output()
-	if durErr != nil {
-		fmt.Println(durErr)
+	if r.SegmentDir != "" {
+		return r.generateSegmented(ctx, workDir, fileName, tpl, timeline, textPaths, progress)
 	}
 
-	// Convert the output to a float
-	duration, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	audioFileName, err := r.StitchAudio(ctx, timeline, workDir, progress)
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
 
-	fmt.Println("Video duration:", duration)
-	// Cut the video from the duration to the end
-	stitchOut, stitchErr := exec.Command(
-		"ffmpeg", "-i", "videos/"+videoName+".mp4",
-		"-ss", strconv.FormatFloat(duration+10, 'f', -1, 64),
-		"-c", "copy",
-		"videos/output/"+fileName+".mp4").CombinedOutput()
-
-	fmt.Println("Stitching video...")
-
-	fmt.Printf("\n\n")
-
-	fmt.Printf("\n\n")
-	fmt.Println("", string(stitchOut))
+	// Cut the base video to the length of the timeline
+	var trimmer = ffmpeg.FFMPEGCommand{
+		Args: []string{
+			"-i", timeline.Video.Path,
+			"-t", strconv.FormatFloat(timeline.Duration, 'f', 3, 64),
+			"-c", "copy",
+			filepath.Join(workDir, "trimmed.mp4"),
+		},
+	}
 
-	if stitchErr != nil {
-		fmt.Println("Error stitching videos:", stitchErr)
+	if err := r.runStage(ctx, "trim", &trimmer, timeline.Duration, progress); err != nil {
+		return err
 	}
 
 	// Make A/V combine function
 	var combiner = ffmpeg.FFMPEGCommand{}
 
 	combiner.CombineVideoAudio(
-		"videos/output/"+fileName+".mp4",
+		filepath.Join(workDir, "trimmed.mp4"),
 		audioFileName,
-		"videos/output/"+fileName+"-av.mp4",
+		filepath.Join(workDir, "av.mp4"),
 	)
 
-	combinedAVCmd := combiner.Command
-	combinedAVOut, combinedAVErr := exec.Command("sh", "-c", combinedAVCmd).CombinedOutput()
-
-	fmt.Printf("COMBINED OUT\n\n")
-	fmt.Println("", string(combinedAVOut))
-	fmt.Printf("\n")
-
-	if combinedAVErr != nil {
-		fmt.Println("Error combining audio and video:", combinedAVErr)
+	if err := r.runStage(ctx, "combine", &combiner, timeline.Duration, progress); err != nil {
+		return err
 	}
 
 	// Make the final video using the base video
 	var finalVideoCmd = ffmpeg.FFMPEGCommand{
-		Input:      "videos/output/" + fileName + "-av.mp4",
-		Out:        "videos/output/" + fileName + "-final",
+		Input:      filepath.Join(workDir, "av.mp4"),
+		Out:        filepath.Join(r.OutputDir, fileName+"-final"),
 		FileType:   "mp4",
 		ShouldCopy: false,
 	}
 
 	finalVideoCmd.Configure()
 
+	// Add logo, intro and outro
+	if err := addBranding(&finalVideoCmd, tpl, timeline, workDir); err != nil {
+		return err
+	}
 	// Add text to the video
-	finalVideoCmd.Command += " -vf "
-	// Add logo
-	finalVideoCmd.Command += LOGO + "," + INTRO_TEXT + "," + OUTRO_DISCLAIMER_TEXT + GenerateOutroFromDur(totalDuration) + ","
-	addText(&finalVideoCmd, optArrText)
+	addText(&finalVideoCmd, timeline, textPaths, tpl)
 
-	//	fmt.Println("Making final video...")
-	//	fmt.Printf("\n\n")
+	// Encoded like the segments, so both render paths give the same quality
+	finalVideoCmd.Args = append(finalVideoCmd.Args, r.videoEncoding()...)
+	finalVideoCmd.MakeCommand("", "", true)
 
-	command := finalVideoCmd.MakeCommand("ultrafast", "ultrafast", true)
+	if err := r.runStage(ctx, "final encode", &finalVideoCmd, timeline.Duration, progress); err != nil {
+		return err
+	}
 
-	fmt.Println(command)
-	fmt.Printf("\n")
+	return nil
+}
 
-	finalOut, finalErr := exec.Command("sh", "-c", command).CombinedOutput()
+// Mix the audio clips of the timeline into a single audio file in outDir, as long as the whole video
+// Returns the path of the stitched audio file
+func (r *Renderer) StitchAudio(ctx context.Context, timeline *Timeline, outDir string, progress ProgressFunc) (string, error) {
+	var mediator = filepath.Join(outDir, "audioMediator")
+
+	var audio = clipAudio(timeline.Clips())
+
+	if len(audio) == 0 {
+		return "", fmt.Errorf("the video has no audio")
+	}
 
-	fmt.Printf("FINAL OUT:\n\n")
-	fmt.Println("", string(finalOut))
-	fmt.Printf("\n\n")
+	var audioCmd = ffmpeg.FFMPEGCommand{}
+	audioCmd.StitchAudio(audio, timeline.Duration, mediator, "aac")
 
-	if finalErr != nil {
-		fmt.Println("Error running command:", finalErr)
+	if err := r.runStage(ctx, "audio stitch", &audioCmd, timeline.Duration, progress); err != nil {
+		return "", err
 	}
 
-	// Call the unsued funtions
-	UNUSED(finalOut)
-	UNUSED(stitchOut)
-	UNUSED(combinedAVOut)
+	return mediator + ".aac", nil
 }
 
-// Stitch audio files together
-func StitchAudio(fileList string) string {
-	// Remove mediator file if it exists
-	removeMediatorErr := os.Remove("audio/output/audioMediator.aac")
+// The clips as ffmpeg audio inputs, placed at their start
+func clipAudio(clips []Clip) []ffmpeg.FFMPEGAudio {
+	var audio []ffmpeg.FFMPEGAudio
+	for _, clip := range clips {
+		audio = append(audio, ffmpeg.FFMPEGAudio{
+			Input:    strings.TrimSuffix(clip.Asset.Path, catalog.AUDIO_EXT),
+			FileType: strings.TrimPrefix(catalog.AUDIO_EXT, "."),
+			Start:    clip.Start,
+			Duration: clip.Duration(),
+		})
+	}
+	return audio
+}
 
-	if removeMediatorErr != nil {
-		fmt.Println("audioMediator.aac does not exist, proceeding to create it")
+// Find an audio clip in the catalog by the name the client sent, and get its duration rounded to two decimals
+// Returns a MissingAssetError if the catalog doesn't know it, and a ProbeError if it can't be probed
+func (r *Renderer) lookupAudio(ctx context.Context, name string) (catalog.Asset, float64, error) {
+	audio, ok := r.Assets.Audio(name)
+	var assetName = "audio/" + name + catalog.AUDIO_EXT
+	if !ok {
+		return catalog.Asset{}, 0, &MissingAssetError{Path: assetName}
 	}
 
-	var audioCmd = ffmpeg.FFMPEGCommand{
-		Input:    fileList,
-		Out:      "audio/output",
-		FileType: "aac",
+	// The prober only runs ffprobe again if the file changed since the catalog was loaded
+	duration, err := r.Prober.Duration(ctx, audio.Path)
+	if err != nil {
+		return catalog.Asset{}, 0, probeError(assetName, audio.Path, err)
 	}
 
-	audioCmd.StitchAudio(fileList, "audio/output/audioMediator", "aac")
+	return audio, roundDuration(duration), nil
+}
 
-	// debug output
-	fmt.Println("Audio command:", audioCmd.Command)
+// Round a duration to two decimal places, the timings of the text are calculated from these
+func roundDuration(duration float64) float64 {
+	return math.Round(duration*100) / 100
+}
 
-	fmt.Printf("\n")
-	audioOut, audioErr := exec.Command("sh", "-c", audioCmd.Command).CombinedOutput()
+// Function for generating the text with ffmpeg
+// It takes the timeline and the textfiles made for each of its sections
+// Each section's title and text are shown for exactly as long as the section's narration
+func addText(f *ffmpeg.FFMPEGCommand, timeline *Timeline, textPaths []string, tpl *branding.Template) {
+	for idx, section := range timeline.Sections {
+		var span = section.Span
 
-	fmt.Println("\n\nAUDIO OUT ", string(audioOut))
-	fmt.Printf("\n\n")
+		var titleText = styledText(tpl.Title, textPaths[idx]+"-title.txt", &span)
+		var textText = styledText(tpl.Text, textPaths[idx]+"-text.txt", &span)
 
-	if audioErr != nil {
-		fmt.Println("Error running command:", audioErr)
+		f.AddText(&titleText)
+		f.AddText(&textText)
 	}
-	UNUSED(audioOut)
-	return "audio/output/audioMediator.aac"
 }
 
-func getDurationInSeconds(filename string) (float64, error) {
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-
-	// Run probe command and capture the duration metadata
-	command := exec.Command("sh", "-c", "ffprobe -show_entries format=duration -v error -of csv='p=0' -i "+filename)
+// Add the template's logo for the whole video, the intro text during the intro and the outro text during the outro,
+// and then the template's image overlays
+func addBranding(f *ffmpeg.FFMPEGCommand, tpl *branding.Template, timeline *Timeline, workDir string) error {
+	var blocks = []struct {
+		name  string
+		block branding.TextBlock
+		span  *Span
+	}{
+		{"logo", tpl.Logo, nil},
+		{"intro", tpl.Intro, &timeline.Intro},
+		{"outro", tpl.Outro, &timeline.Outro},
+	}
 
-	command.Stdout = &out
-	command.Stderr = &stderr
+	for _, b := range blocks {
+		// Every part of the template is optional, and a segment may not have an intro or outro
+		if b.block.Text == "" || (b.span != nil && b.span.Duration() <= 0) {
+			continue
+		}
 
-	err := command.Run()
+		path, err := GenerateBlockFile(workDir, b.name, b.block)
+		if err != nil {
+			return err
+		}
 
-	if err != nil {
-		println("Error getting duration of audio: ", err.Error())
-		return 0, err
+		var text = styledText(b.block.Style, path, b.span)
+		f.AddText(&text)
 	}
 
-	// Convert the output to a string
-	duration := out.String()
+	// The images go on top of everything
+	for _, o := range tpl.Overlays {
+		var overlay = ffmpeg.FFMPEGOverlay{
+			Image:   o.Image,
+			Anchor:  o.Anchor,
+			MarginX: o.MarginX,
+			MarginY: o.MarginY,
+			Scale:   o.Scale,
+			Opacity: o.Opacity,
+		}
 
-	// Remove the newline character
-	duration = strings.TrimSuffix(duration, "\n")
+		if span, ok := timeline.window(o.During); ok {
+			if span.Duration() <= 0 {
+				continue
+			}
 
-	// Round the duration to two decimal places
-	durationFloat, err := strconv.ParseFloat(duration, 64)
+			overlay.HasDuration = true
+			overlay.TimeFrom = span.Start
+			overlay.TimeTo = span.End
+		}
 
-	roundedDuration := fmt.Sprintf("%.2f", durationFloat)
+		f.AddOverlay(&overlay)
+	}
 
-	roundedDurationFloat, err := strconv.ParseFloat(roundedDuration, 64)
+	return nil
+}
 
-	// Debug
-	// println("DURATION: ", durationFloat)
-	// println("ROUNDED DUR: ", roundedDuration)
+// Make a drawtext from a text file with the template style, shown during span or the whole video if span is nil
+func styledText(style branding.TextStyle, textFile string, span *Span) ffmpeg.FFMPEGText {
+	var text = ffmpeg.FFMPEGText{
+		TextFile:   true,
+		Data:       textFile,
+		FadeIn:     style.FadeIn,
+		FadeOut:    style.FadeOut,
+		FontFile:   style.FontFile,
+		LineHeight: style.LineSpacing,
+		FontSize:   style.FontSize,
+		FontColor:  style.FontColor,
+		X:          style.X,
+		Y:          style.Y,
+	}
 
-	if err != nil {
-		println("Error converting duration to float: ", err.Error())
-		return 0, err
+	if span != nil {
+		text.HasDuration = true
+		text.TimeFrom = span.Start
+		text.TimeTo = span.End
 	}
 
-	return roundedDurationFloat, nil
+	return text
 }
 
-// Function for generating the text with ffmpeg
-// It takes an array of textfiles to be used
-// It makes a command that concatenates all the textfiles onto a single video
-func addText(f *ffmpeg.FFMPEGCommand, options []SanitizedOption) {
-	var xPosTitle = 52
-	var xPosText = 52
-
-	var yPosTitle = 64
-	var yPosText = 124
-
-	var delay = float64(0.25)
-
-	var durSoFar float64 = 0
-	var durFrom = durSoFar
-	var durTo = float64(options[0].Duration)
-
-	for idx, opt := range options {
-		// add 5 seconds to initial text
-		if idx == 0 {
-			durSoFar += 5
-			durFrom += 5
-			durTo += 5
-		}
-		// Increment duration variables
-		// Also add delay to from and to variables
-		if idx != 0 {
-			durFrom += durSoFar
-			durTo += float64(opt.Duration) + delay
-		}
-
-		var titleText = ffmpeg.FFMPEGText{
-			TextFile:    true,
-			Data:        "text/" + opt.Text + "-title.txt",
-			HasDuration: true,
-			TimeFrom:    durSoFar,
-			TimeTo:      durTo,
-			FadeIn:      1.3,
-			FadeOut:     2,
-			FontFile:    "fonts/TitilliumWeb-SemiBold.ttf",
-			LineHeight:  2,
-			FontSize:    52,
-			FontColor:   "black",
-			X:           xPosTitle,
-			Y:           yPosTitle,
-		}
-
-		var textText = ffmpeg.FFMPEGText{
-			TextFile:    true,
-			Data:        "text/" + opt.Text + "-text.txt",
-			HasDuration: true,
-			TimeFrom:    durSoFar,
-			TimeTo:      durTo,
-			FadeIn:      2,
-			FadeOut:     2,
-			FontFile:    "fonts/TitilliumWeb-SemiBold.ttf",
-			LineHeight:  2,
-			FontSize:    40,
-			FontColor:   "black",
-			X:           xPosText,
-			Y:           yPosText,
+func main() {
+	// The keys command has flags of its own, and runs instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		if err := runKeysCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
 
-		f.AddText(&titleText, false)
-
-		// Last title is not last, the text that comes after is
-		if idx == len(options)-1 {
-			f.AddText(&textText, true)
-		} else {
-			f.AddText(&textText, false)
-		}
+	cfg, err := LoadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal("Invalid config:\n", err)
+	}
 
-		durSoFar += float64(opt.Duration) + delay
+	if err := setupLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+		log.Fatal(err)
 	}
-}
 
-func main() {
-	StartServer(false)
+	StartServer(cfg)
 
 	// A story written by Github copilot directed by Mathias Wøbbe
 	// It starts with a guy in a hat
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"server/branding"
+)
+
+// The bullets are indented and prefixed as the template says, with the defaults if it doesn't
+func TestGenerateTextFile(t *testing.T) {
+	templates, err := branding.Load(TEMPLATE_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl, ok := templates.Get("mit-hjerte")
+	if !ok {
+		t.Fatal("no mit-hjerte template")
+	}
+
+	var custom = *tpl
+	custom.Text.Indent = 2
+	custom.Text.Prefix = "- "
+	custom.Text.Wrap = 20
+
+	var option = ParentOption{Name: "Symptomer", Options: []Option{
+		{Name: "Hjertebanken og åndenød ved anstrengelse", Active: true},
+		{Name: "Svimmelhed"},
+	}}
+
+	for _, test := range []struct {
+		name string
+		tpl  *branding.Template
+		want string
+	}{
+		// The wrapper leaves a space after every word
+		{"defaults", tpl, "  • Hjertebanken og åndenød ved anstrengelse \n"},
+		{"template", &custom, "- Hjertebanken og \n  åndenød ved \n  anstrengelse \n"},
+	} {
+		path, err := GenerateTextFile(t.TempDir(), option, test.tpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		text, err := os.ReadFile(path + "-text.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(text) != test.want {
+			t.Errorf("%s: text %q, want %q", test.name, text, test.want)
+		}
+	}
+}
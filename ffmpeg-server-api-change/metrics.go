@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Every metric of the server is registered here and served on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "How long HTTP requests took to answer, by route and method. Event streams last as long as the client listens.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	jobsFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "render_jobs_finished_total",
+		Help: "Render jobs that finished, by status.",
+	}, []string{"status"})
+
+	stageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "render_stage_duration_seconds",
+		Help:    "How long each ffmpeg render stage took, failed stages included.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 12), // 0.5s to 17m
+	}, []string{"stage"})
+
+	stageSpeed = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "render_stage_speed_ratio",
+		Help:    "Seconds of video each successful ffmpeg render stage got through per second, 1 is real time.",
+		Buckets: []float64{0.25, 0.5, 1, 2, 4, 8, 16, 32, 64},
+	}, []string{"stage"})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "render_cache_requests_total",
+		Help: "Looks in the caches, by cache (video or segment) and result (hit or miss).",
+	}, []string{"cache", "result"})
+
+	outputBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "render_output_bytes_total",
+		Help: "Bytes of finished videos written.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpRequestDuration,
+		jobsFinished,
+		stageDuration,
+		stageSpeed,
+		cacheRequests,
+		outputBytes,
+	)
+}
+
+// Count a look in a cache, hit or miss
+func countCache(cache string, hit bool) {
+	var result = "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// Record how long a render stage took, and how fast it went through the duration seconds of video
+func observeStage(stage string, took time.Duration, duration float64, err error) {
+	stageDuration.WithLabelValues(stage).Observe(took.Seconds())
+
+	if err == nil && duration > 0 && took > 0 {
+		stageSpeed.WithLabelValues(stage).Observe(duration / took.Seconds())
+	}
+}
+
+var (
+	jobsDesc        = prometheus.NewDesc("render_jobs", "Render jobs the server knows of, by status.", []string{"status"}, nil)
+	queueLengthDesc = prometheus.NewDesc("render_queue_length", "Render jobs waiting for a worker.", nil, nil)
+	queueMaxDesc    = prometheus.NewDesc("render_queue_max_length", "Most render jobs that may wait for a worker.", nil, nil)
+	workersDesc     = prometheus.NewDesc("render_workers", "Videos rendered at the same time at most.", nil, nil)
+)
+
+// Reads the jobs and the queue of the job manager every time the metrics are scraped
+type jobsCollector struct {
+	jobs *JobManager
+}
+
+func (c jobsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- jobsDesc
+	ch <- queueLengthDesc
+	ch <- queueMaxDesc
+	ch <- workersDesc
+}
+
+func (c jobsCollector) Collect(ch chan<- prometheus.Metric) {
+	var stats = c.jobs.Stats()
+
+	for status, count := range c.jobs.CountByStatus() {
+		ch <- prometheus.MustNewConstMetric(jobsDesc, prometheus.GaugeValue, float64(count), string(status))
+	}
+
+	ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(stats.QueueLength))
+	ch <- prometheus.MustNewConstMetric(queueMaxDesc, prometheus.GaugeValue, float64(stats.MaxQueue))
+	ch <- prometheus.MustNewConstMetric(workersDesc, prometheus.GaugeValue, float64(stats.Workers))
+}
+
+// Serve the metrics on /metrics of the internal mux, see Config.InternalAddr
+func handleMetrics(mux *http.ServeMux, jobs *JobManager) {
+	metricsRegistry.MustRegister(jobsCollector{jobs: jobs})
+
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// Count every request and how long it took, by the route of the mux that handles it
+func instrumentHandler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The pattern, not the path, so job ids don't each get a series of their own
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		var recorder = &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		var start = time.Now()
+
+		mux.ServeHTTP(recorder, r)
+
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Remembers the status code written, and still lets event streams flush
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
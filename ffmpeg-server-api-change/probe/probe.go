@@ -0,0 +1,210 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A single stream of a media file
+type Stream struct {
+	Index      int     `json:"index"`
+	CodecType  string  `json:"codecType"` // "audio", "video", "subtitle" ...
+	CodecName  string  `json:"codecName"`
+	SampleRate int     `json:"sampleRate,omitempty"`
+	Channels   int     `json:"channels,omitempty"`
+	Width      int     `json:"width,omitempty"`
+	Height     int     `json:"height,omitempty"`
+	FrameRate  float64 `json:"frameRate,omitempty"`
+	Duration   float64 `json:"duration,omitempty"`
+	Language   string  `json:"language,omitempty"`
+}
+
+// Everything ffprobe tells us about a media file
+type Info struct {
+	Path       string   `json:"path"`
+	FormatName string   `json:"formatName"`
+	Duration   float64  `json:"duration"` // In seconds
+	BitRate    int64    `json:"bitRate,omitempty"`
+	Size       int64    `json:"size"`
+	Streams    []Stream `json:"streams"`
+}
+
+// The first audio stream, if there is one
+func (i *Info) Audio() (Stream, bool) {
+	return i.firstOf("audio")
+}
+
+// The first video stream, if there is one
+func (i *Info) Video() (Stream, bool) {
+	return i.firstOf("video")
+}
+
+func (i *Info) firstOf(codecType string) (Stream, bool) {
+	for _, s := range i.Streams {
+		if s.CodecType == codecType {
+			return s, true
+		}
+	}
+	return Stream{}, false
+}
+
+type cacheEntry struct {
+	modTime time.Time
+	size    int64
+	info    *Info
+}
+
+// Prober runs ffprobe and remembers the results.
+// A cached result is used as long as the file has the same modification time and size.
+type Prober struct {
+	Binary string // Path of ffprobe
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+func New(binary string) *Prober {
+	return &Prober{
+		Binary: binary,
+		cache:  make(map[string]cacheEntry),
+	}
+}
+
+// Get the media information of the file at path, from the cache if it hasn't changed.
+// The returned Info is shared, don't modify it.
+func (p *Prober) Probe(ctx context.Context, path string) (*Info, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	entry, ok := p.cache[path]
+	p.mu.Unlock()
+
+	if ok && entry.modTime.Equal(stat.ModTime()) && entry.size == stat.Size() {
+		return entry.info, nil
+	}
+
+	info, err := p.run(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.cache[path] = cacheEntry{modTime: stat.ModTime(), size: stat.Size(), info: info}
+	p.mu.Unlock()
+
+	return info, nil
+}
+
+// Get only the duration of the file at path, in seconds
+func (p *Prober) Duration(ctx context.Context, path string) (float64, error) {
+	info, err := p.Probe(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Duration, nil
+}
+
+// The JSON ffprobe prints with -print_format json, numbers are mostly strings
+type ffprobeOutput struct {
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+		Size       string `json:"size"`
+	} `json:"format"`
+	Streams []struct {
+		Index        int               `json:"index"`
+		CodecType    string            `json:"codec_type"`
+		CodecName    string            `json:"codec_name"`
+		SampleRate   string            `json:"sample_rate"`
+		Channels     int               `json:"channels"`
+		Width        int               `json:"width"`
+		Height       int               `json:"height"`
+		AvgFrameRate string            `json:"avg_frame_rate"`
+		Duration     string            `json:"duration"`
+		Tags         map[string]string `json:"tags"`
+	} `json:"streams"`
+}
+
+func (p *Prober) run(ctx context.Context, path string) (*Info, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, p.Binary, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var out ffprobeOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("reading ffprobe output: %v", err)
+	}
+
+	duration, err := strconv.ParseFloat(out.Format.Duration, 64)
+	if err != nil {
+		return nil, fmt.Errorf("no duration in ffprobe output: %v", err)
+	}
+
+	var info = &Info{
+		Path:       path,
+		FormatName: out.Format.FormatName,
+		Duration:   duration,
+	}
+	info.BitRate, _ = strconv.ParseInt(out.Format.BitRate, 10, 64)
+	info.Size, _ = strconv.ParseInt(out.Format.Size, 10, 64)
+
+	for _, s := range out.Streams {
+		var stream = Stream{
+			Index:     s.Index,
+			CodecType: s.CodecType,
+			CodecName: s.CodecName,
+			Channels:  s.Channels,
+			Width:     s.Width,
+			Height:    s.Height,
+			FrameRate: parseRate(s.AvgFrameRate),
+		}
+		stream.SampleRate, _ = strconv.Atoi(s.SampleRate)
+		stream.Duration, _ = strconv.ParseFloat(s.Duration, 64)
+
+		// "und" is what ffprobe reports when the language is not set
+		if language := s.Tags["language"]; language != "und" {
+			stream.Language = language
+		}
+
+		info.Streams = append(info.Streams, stream)
+	}
+
+	return info, nil
+}
+
+// Parse a rate like "25/1" or "30000/1001", ffprobe reports "0/0" when it doesn't know
+func parseRate(rate string) float64 {
+	num, den, ok := strings.Cut(rate, "/")
+	if !ok {
+		f, _ := strconv.ParseFloat(rate, 64)
+		return f
+	}
+
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || d == 0 {
+		return 0
+	}
+
+	return n / d
+}
@@ -0,0 +1,72 @@
+package main
+
+import "math"
+
+// Called while a render stage runs, with how much of the stage is done (0 to 1) and ffmpeg's speed
+type ProgressFunc func(stage string, done float64, speed float64)
+
+type renderStage struct {
+	Name   string
+	Weight float64
+}
+
+// The render stages in the order they run, and roughly how much of the render time each one takes.
+// The final encode draws all the text and re-encodes the video, the others mostly copy streams.
+var RENDER_STAGES = []renderStage{
+	{"audio stitch", 0.10},
+	{"trim", 0.05},
+	{"combine", 0.05},
+	{"final encode", 0.80},
+}
+
+// The same for a render made of segments, joining them is only copying
+var SEGMENTED_STAGES = []renderStage{
+	{"segments", 0.95},
+	{"concat", 0.05},
+}
+
+// How far a job has come, as sent to the client
+type Progress struct {
+	Stage        string  `json:"stage"`
+	Percent      float64 `json:"percent"`      // Of the whole render
+	StagePercent float64 `json:"stagePercent"` // Of the current stage
+	Speed        float64 `json:"speed,omitempty"`
+
+	QueuePosition int `json:"queuePosition,omitempty"` // Only while the job waits in the queue
+}
+
+// Turn the progress of a single stage into the progress of the whole render
+func renderProgress(stage string, done float64, speed float64) Progress {
+	var before = 0.0
+	var weight = 0.0
+
+	for _, stages := range [][]renderStage{RENDER_STAGES, SEGMENTED_STAGES} {
+		before = 0
+
+		for _, s := range stages {
+			if s.Name == stage {
+				weight = s.Weight
+				break
+			}
+			before += s.Weight
+		}
+
+		if weight > 0 {
+			break
+		}
+	}
+
+	// Unknown stages don't move the bar
+	if weight == 0 {
+		before = 0
+	}
+
+	done = math.Max(0, math.Min(done, 1))
+
+	return Progress{
+		Stage:        stage,
+		Percent:      math.Round((before+weight*done)*1000) / 10,
+		StagePercent: math.Round(done*1000) / 10,
+		Speed:        speed,
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestRenderProgress(t *testing.T) {
+	for _, test := range []struct {
+		stage        string
+		done         float64
+		percent      float64
+		stagePercent float64
+	}{
+		{"audio stitch", 0, 0, 0},
+		{"audio stitch", 1, 10, 100},
+		{"trim", 0.5, 12.5, 50},
+		{"final encode", 0.5, 60, 50},
+		{"final encode", 1, 100, 100},
+		{"segments", 0.5, 47.5, 50},
+		{"concat", 1, 100, 100},
+		// Out of range is clamped, unknown stages don't move the bar
+		{"final encode", 1.2, 100, 100},
+		{"trim", -1, 10, 0},
+		{"probe", 0.5, 0, 50},
+	} {
+		var progress = renderProgress(test.stage, test.done, 2)
+		if progress.Stage != test.stage || progress.Percent != test.percent || progress.StagePercent != test.stagePercent || progress.Speed != 2 {
+			t.Errorf("%s %v: %+v, want %v%% of the render and %v%% of the stage", test.stage, test.done, progress, test.percent, test.stagePercent)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"server/branding"
+	"server/catalog"
+)
+
+// The finished videos are written here, and kept as a cache for requests that render the same video
+const OUTPUT_DIR = "videos/output"
+
+// The cached videos are removed when they haven't been asked for in this long,
+// and the least recently used ones first when together they take up more than this, unless configured otherwise
+const CACHE_MAX_AGE = 30 * 24 * time.Hour
+const CACHE_MAX_BYTES int64 = 20 << 30
+
+// How often old videos are looked for
+const CACHE_SWEEP_INTERVAL = time.Hour
+
+// Where the video of a job ends up
+func (r *Renderer) outputPath(fileName string) string {
+	return filepath.Join(r.OutputDir, fileName+"-final.mp4")
+}
+
+// The version of a file that goes into a video, the video changes when the file does
+type fileVersion struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+func assetVersion(asset catalog.Asset) fileVersion {
+	return fileVersion{Path: asset.Path, Size: asset.Size, ModTime: asset.ModTime}
+}
+
+// Everything that decides how a video looks and sounds, and nothing else.
+// Two requests with the same renderKey give the same video.
+type renderKey struct {
+	Template *branding.Template `json:"template"`
+	Files    []fileVersion      `json:"files"` // The fonts and images of the template
+	Video    fileVersion        `json:"video"`
+	Sections []sectionKey       `json:"sections"`
+	Encoding []string           `json:"encoding"` // The encoder settings, a video encoded differently is another video
+}
+
+type sectionKey struct {
+	Title   string       `json:"title"`
+	Lead    *fileVersion `json:"lead,omitempty"`
+	Options []optionKey  `json:"options"`
+}
+
+type optionKey struct {
+	Text  string      `json:"text"`
+	Audio fileVersion `json:"audio"`
+	Delay float64     `json:"delay"`
+}
+
+// The version of every font and image the template uses
+func templateFiles(tpl *branding.Template) ([]fileVersion, error) {
+	var paths = []string{tpl.Logo.Style.FontFile, tpl.Intro.Style.FontFile, tpl.Outro.Style.FontFile, tpl.Title.FontFile, tpl.Text.FontFile}
+	for _, o := range tpl.Overlays {
+		paths = append(paths, o.Image)
+	}
+
+	var files []fileVersion
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fileVersion{Path: path, Size: info.Size(), ModTime: info.ModTime()})
+	}
+
+	return files, nil
+}
+
+// Hash what the request renders: the options that end up in the video, the template and the version of every
+// file used. Ids, descriptions, inactive options and the order of JSON fields don't change the hash.
+// The request must be valid.
+func (r *Renderer) RequestHash(request JSONObj) (string, error) {
+	if len(request.Payload) != 1 {
+		return "", fmt.Errorf("expected exactly one video, got %d", len(request.Payload))
+	}
+
+	tpl, ok := r.template(request.Template)
+	if !ok {
+		return "", fmt.Errorf("unknown template %q", request.Template)
+	}
+
+	var video = request.Payload[0]
+
+	videoAsset, ok := r.Assets.Video(video.Id + "_Long")
+	if !ok {
+		return "", &MissingAssetError{Path: "videos/" + video.Id + "_Long" + catalog.VIDEO_EXT}
+	}
+
+	files, err := templateFiles(tpl)
+	if err != nil {
+		return "", err
+	}
+
+	var key = renderKey{Template: tpl, Files: files, Video: assetVersion(videoAsset), Encoding: append(r.videoEncoding(), audioEncoding()...)}
+
+	var audio = func(name string) (fileVersion, error) {
+		asset, ok := r.Assets.Audio(name)
+		if !ok {
+			return fileVersion{}, &MissingAssetError{Path: "audio/" + name + catalog.AUDIO_EXT}
+		}
+		return assetVersion(asset), nil
+	}
+
+	for _, parentOpt := range video.ParentOptions {
+		var section = sectionKey{Title: parentOpt.Name, Options: []optionKey{}}
+
+		// Same as the timeline: the introduction replaces the option's own audio
+		var leadAudio = parentOpt.Introduction
+		if leadAudio == "" {
+			leadAudio = parentOpt.AudioName
+		}
+
+		if leadAudio != "" {
+			lead, err := audio(leadAudio)
+			if err != nil {
+				return "", err
+			}
+			section.Lead = &lead
+		}
+
+		for _, option := range parentOpt.Options {
+			if !option.Active {
+				continue
+			}
+
+			version, err := audio(option.AudioName)
+			if err != nil {
+				return "", err
+			}
+			section.Options = append(section.Options, optionKey{Text: option.Name, Audio: version, Delay: option.Delay})
+		}
+
+		key.Sections = append(key.Sections, section)
+	}
+
+	// Struct fields are always marshaled in the same order, so the JSON is canonical
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+
+	var sum = sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// The job whose video the request with this hash can use: one that is queued, running or has a video in the cache.
+// Must be called with the lock held.
+func (m *JobManager) cached(hash string) (*Job, bool) {
+	if hash == "" {
+		return nil, false
+	}
+
+	job, ok := m.byHash[hash]
+	if !ok {
+		return nil, false
+	}
+
+	var now = time.Now()
+	job.LastUsedAt = &now
+
+	return job, true
+}
+
+// Forget the job as the one to use for its hash, when it failed or its video is gone.
+// Must be called with the lock held.
+func (m *JobManager) uncache(job *Job) {
+	if m.byHash[job.hash] == job {
+		delete(m.byHash, job.hash)
+	}
+}
+
+// Remove cached videos that haven't been used for cacheMaxAge, and then the least recently used ones
+// until they take up less than cacheMaxBytes. Must be called with the lock held.
+func (m *JobManager) sweepCache() {
+	var cached []*Job
+	var total int64
+
+	for _, job := range m.byHash {
+		if job.Status != JobSucceeded {
+			continue
+		}
+
+		if job.LastUsedAt != nil && time.Since(*job.LastUsedAt) > m.cacheMaxAge {
+			m.expire(job, "not used for "+m.cacheMaxAge.String())
+			continue
+		}
+
+		cached = append(cached, job)
+		total += job.outputSize
+	}
+
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].LastUsedAt.Before(*cached[j].LastUsedAt)
+	})
+
+	for _, job := range cached {
+		if total <= m.cacheMaxBytes {
+			break
+		}
+
+		total -= job.outputSize
+		m.expire(job, "the cache is full")
+	}
+}
+
+// Remove the video of a job from the cache. Must be called with the lock held.
+func (m *JobManager) expire(job *Job, reason string) {
+	slog.Info("removing cached video", "job", job.Id, "reason", reason)
+
+	if err := os.Remove(m.renderer.outputPath(job.fileName)); err != nil && !os.IsNotExist(err) {
+		slog.Error("removing cached video", "job", job.Id, "error", err)
+		return
+	}
+
+	m.uncache(job)
+	job.Status = JobExpired
+	job.URL = ""
+	m.save(job)
+}
+
+// Sweep the cache, the old jobs, the old Idempotency-Keys and the logs of gone jobs every CACHE_SWEEP_INTERVAL, until the shutdown
+func (m *JobManager) sweeper() {
+	for range time.Tick(CACHE_SWEEP_INTERVAL) {
+		m.mu.Lock()
+		if m.closing {
+			m.mu.Unlock()
+			return
+		}
+		m.sweepCache()
+		m.sweepJobs()
+		m.sweepKeys()
+		m.sweepJobLogs()
+		m.mu.Unlock()
+	}
+}
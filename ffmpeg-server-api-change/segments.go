@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	ffmpeg "nrt/ffmpeg"
+	"server/branding"
+	"server/fileutil"
+)
+
+// Every segment is kept here after it's rendered, so the next video with the same segment only copies it
+const SEGMENT_DIR = "cache/segments"
+
+// The least recently used segments are removed when together they take up more than this, unless configured otherwise
+const SEGMENT_CACHE_MAX_BYTES int64 = 10 << 30
+
+// A segment used this recently is never removed, a render may be about to join it
+const SEGMENT_MIN_AGE = time.Hour
+
+// Changed when the way segments are encoded changes, so old segments are never joined with new ones
+const SEGMENT_FORMAT = 2
+
+// How the video of every segment, and of a single pass render, is encoded.
+// The segments must all be encoded the same way, or they can't be joined without re-encoding.
+func (r *Renderer) videoEncoding() []string {
+	return []string{"-c:v", "libx264", "-preset:v", r.Preset, "-tune", "fastdecode", "-crf", strconv.Itoa(r.CRF), "-pix_fmt", "yuv420p", "-level", "4.2"}
+}
+
+// How the audio of a segmented render is encoded. Segments have no audio: every AAC stream starts with priming samples,
+// which would be heard as a gap at every join, so the audio of the whole timeline is encoded once when they are joined.
+func audioEncoding() []string {
+	return []string{"-c:a", "libfdk_aac", "-b:a", "320k", "-ar", "48k", "-ac", "2"}
+}
+
+// A part of the video that is rendered on its own: the intro, a section or the outro
+type segment struct {
+	Span           // In the whole video
+	Source    Span // The part of the base video it's cut from
+	Name      string
+	timeline  *Timeline // Only the segment, in seconds from its start
+	textPaths []string  // Title and text files of the section in the segment
+}
+
+// Split the video into the intro, a segment per section and the outro.
+// The intro is cut from the start of the base video. Every section and the outro are cut from the base video
+// right after the intro, wherever they are in the video, so a section looks the same in every video it's in
+// and is only rendered once.
+func (t *Timeline) segments(textPaths []string) []segment {
+	var segments []segment
+
+	var add = func(name string, span Span, source float64, textPaths []string) {
+		if span.Duration() <= 0 {
+			return
+		}
+		segments = append(segments, segment{
+			Span:      span,
+			Source:    Span{Start: source, End: source + span.Duration()},
+			Name:      name,
+			timeline:  t.slice(span),
+			textPaths: textPaths,
+		})
+	}
+
+	add("intro", t.Intro, 0, nil)
+	for i, section := range t.Sections {
+		add(fmt.Sprintf("section %d", i+1), section.Span, t.Intro.End, textPaths[i:i+1])
+	}
+	add("outro", t.Outro, t.Intro.End, nil)
+
+	return segments
+}
+
+// The timeline with the intro, every section and the outro made a whole number of frames long, each starting
+// where the one before ends. Their videos then add up to the length of the timeline and keep to the audio,
+// which is mixed for the whole timeline at once, and a section is just as long wherever it is in the video.
+// The clips move along with their section.
+func (t *Timeline) onFrames(frameRate float64) *Timeline {
+	if frameRate <= 0 {
+		return t
+	}
+
+	var frames = func(seconds float64) float64 {
+		return math.Round(seconds*frameRate) / frameRate
+	}
+
+	var snapped = &Timeline{Video: t.Video, Intro: Span{Start: 0, End: frames(t.Intro.Duration())}}
+	var cursor = snapped.Intro.End
+
+	for _, section := range t.Sections {
+		var shift = cursor - section.Start
+		var s = Section{Span: Span{Start: cursor, End: cursor + frames(section.Duration())}, Option: section.Option}
+		for _, clip := range section.Clips {
+			s.Clips = append(s.Clips, Clip{Span: Span{Start: clip.Start + shift, End: clip.End + shift}, Asset: clip.Asset})
+		}
+
+		snapped.Sections = append(snapped.Sections, s)
+		cursor = s.End
+	}
+
+	snapped.Outro = Span{Start: cursor, End: cursor + frames(t.Outro.Duration())}
+	snapped.Duration = snapped.Outro.End
+
+	return snapped
+}
+
+// The timeline as seen from inside window: every span cut to the window and moved to start at 0.
+// Only the sections that overlap the window are kept.
+func (t *Timeline) slice(window Span) *Timeline {
+	var clamp = func(s Span) Span {
+		var start = math.Min(math.Max(s.Start, window.Start), window.End)
+		var end = math.Min(math.Max(s.End, window.Start), window.End)
+		return Span{Start: start - window.Start, End: end - window.Start}
+	}
+
+	var sub = &Timeline{
+		Video:    t.Video,
+		Intro:    clamp(t.Intro),
+		Outro:    clamp(t.Outro),
+		Duration: window.Duration(),
+	}
+
+	for _, section := range t.Sections {
+		var span = clamp(section.Span)
+		if span.Duration() <= 0 {
+			continue
+		}
+
+		var s = Section{Span: span, Option: section.Option}
+		for _, clip := range section.Clips {
+			s.Clips = append(s.Clips, Clip{
+				Span:  Span{Start: clip.Start - window.Start, End: clip.End - window.Start},
+				Asset: clip.Asset,
+			})
+		}
+		sub.Sections = append(sub.Sections, s)
+	}
+
+	return sub
+}
+
+// Everything that decides how a segment looks. Two segments with the same key are the same video,
+// wherever they end up in the videos they are joined into.
+type segmentKey struct {
+	Format   int                `json:"format"`
+	Template *branding.Template `json:"template"`
+	Files    []fileVersion      `json:"files"` // The fonts and images of the template
+	Video    fileVersion        `json:"video"`
+	Source   Span               `json:"source"` // The part of the base video the segment is cut from
+	// The rest is in seconds from the start of the segment
+	Intro    Span     `json:"intro"`
+	Outro    Span     `json:"outro"`
+	Sections []Span   `json:"sections"` // When the texts are shown
+	Texts    []string `json:"texts"`    // What the title and text files say
+	Encoding []string `json:"encoding"`
+}
+
+// The name of the segment in the cache, a hash of its segmentKey
+func (s *segment) key(tpl *branding.Template, encoding []string) (string, error) {
+	files, err := templateFiles(tpl)
+	if err != nil {
+		return "", err
+	}
+
+	var key = segmentKey{
+		Format:   SEGMENT_FORMAT,
+		Template: tpl,
+		Files:    files,
+		Video:    assetVersion(s.timeline.Video),
+		Source:   s.Source,
+		Intro:    s.timeline.Intro,
+		Outro:    s.timeline.Outro,
+		Sections: []Span{},
+		Texts:    []string{},
+		Encoding: encoding,
+	}
+
+	for _, section := range s.timeline.Sections {
+		key.Sections = append(key.Sections, section.Span)
+	}
+
+	for _, path := range s.textPaths {
+		for _, suffix := range []string{"-title.txt", "-text.txt"} {
+			text, err := os.ReadFile(path + suffix)
+			if err != nil {
+				return "", &TextFileError{Path: path + suffix, Err: err}
+			}
+			key.Texts = append(key.Texts, string(text))
+		}
+	}
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+
+	var sum = sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Render the video a segment at a time and join the segments into the output without re-encoding them.
+// Segments that were rendered for an earlier video are taken from the cache, only new ones are encoded,
+// up to SegmentWorkers of them at the same time. If one fails, the others are stopped.
+// The audio of the whole timeline is mixed and encoded while the segments are joined, see audioEncoding.
+func (r *Renderer) generateSegmented(ctx context.Context, workDir string, fileName string, tpl *branding.Template, timeline *Timeline, textPaths []string, progress ProgressFunc) error {
+	var frameRate float64
+	if info, err := r.Prober.Probe(ctx, timeline.Video.Path); err != nil {
+		logFor(ctx).Warn("probing the base video, the segments aren't cut on whole frames", "error", err)
+	} else if video, ok := info.Video(); ok {
+		frameRate = video.FrameRate
+	}
+
+	// The audio is mixed from the same timeline as the segments
+	timeline = timeline.onFrames(frameRate)
+
+	var segments = timeline.segments(textPaths)
+	var paths = make([]string, len(segments))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var firstErr error
+	var rendered = make([]float64, len(segments)) // Seconds of each segment that are rendered
+
+	var wg sync.WaitGroup
+	var slots = make(chan struct{}, r.segmentWorkers())
+
+	for i := range segments {
+		var i = i
+		var seg = &segments[i]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			// Another segment failed while this one waited
+			if ctx.Err() != nil {
+				return
+			}
+
+			// Every segment gets its own directory for the logo, intro and outro text files,
+			// so one segment never rewrites a file another one's ffmpeg is reading
+			var segDir = filepath.Join(workDir, strings.ReplaceAll(seg.Name, " ", "-"))
+
+			path, err := r.renderSegment(ctx, segDir, tpl, seg, func(stage string, done float64, speed float64) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				rendered[i] = done * seg.Duration()
+
+				var ready = 0.0
+				for _, seconds := range rendered {
+					ready += seconds
+				}
+				report(progress, "segments", ready/timeline.Duration, speed)
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+
+			paths[i] = path
+		}()
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	// Canceled before every segment got its turn
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	var list strings.Builder
+	for _, path := range paths {
+		// The list is in the work directory, the segments aren't
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		list.WriteString(fileutil.ConcatEntry(abs))
+	}
+
+	var listPath = filepath.Join(workDir, "segments.txt")
+	if err := os.WriteFile(listPath, []byte(list.String()), 0644); err != nil {
+		return &TextFileError{Path: listPath, Err: err}
+	}
+
+	var concat = ffmpeg.FFMPEGCommand{
+		Args:     []string{"-y", "-f", "concat", "-safe", "0", "-i", listPath},
+		Out:      strings.TrimSuffix(r.outputPath(fileName), ".mp4"),
+		FileType: "mp4",
+	}
+
+	concat.AddPaddedAudio(clipAudio(timeline.Clips()), timeline.Duration)
+	concat.Args = append(concat.Args, "-c:v", "copy")
+	concat.Args = append(concat.Args, audioEncoding()...)
+	concat.Args = append(concat.Args, "-t", strconv.FormatFloat(timeline.Duration, 'f', 3, 64), "-movflags", "+faststart")
+	concat.MakeCommand("", "", false)
+
+	if err := r.runStage(ctx, "concat", &concat, timeline.Duration, progress); err != nil {
+		return err
+	}
+
+	r.sweepSegments()
+
+	return nil
+}
+
+// How many segments are encoded at the same time
+func (r *Renderer) segmentWorkers() int {
+	if r.SegmentWorkers > 0 {
+		return r.SegmentWorkers
+	}
+
+	return runtime.NumCPU()
+}
+
+// Get the segment from the cache, or render it into the cache. Returns the path of the segment.
+// The files the segment needs are made in workDir, it's made if it doesn't exist.
+func (r *Renderer) renderSegment(ctx context.Context, workDir string, tpl *branding.Template, seg *segment, progress ProgressFunc) (string, error) {
+	ctx = withLogger(ctx, logFor(ctx).With("segment", seg.Name))
+
+	key, err := seg.key(tpl, r.videoEncoding())
+	if err != nil {
+		return "", err
+	}
+
+	var path = filepath.Join(r.SegmentDir, key+".mp4")
+
+	_, err = os.Stat(path)
+	countCache("segment", err == nil)
+
+	if err == nil {
+		logFor(ctx).Info("using cached segment")
+
+		// Used again, so it's kept the longest
+		var now = time.Now()
+		os.Chtimes(path, now, now)
+
+		report(progress, "segment", 1, 0)
+		return path, nil
+	}
+
+	logFor(ctx).Info("rendering segment")
+
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return "", err
+	}
+
+	// Rendered next to the cached segments and moved in place when done, so a half rendered segment is never used
+	var tmp = filepath.Join(r.SegmentDir, key+"-"+uuid.New().String()+".tmp")
+
+	var secs = func(s float64) string {
+		return strconv.FormatFloat(s, 'f', 3, 64)
+	}
+
+	var cmd = ffmpeg.FFMPEGCommand{
+		// Seek before the input, the segment starts at 0
+		Args:     []string{"-y", "-ss", secs(seg.Source.Start), "-t", secs(seg.Duration()), "-i", seg.timeline.Video.Path},
+		Out:      tmp,
+		FileType: "mp4",
+	}
+
+	if err := addBranding(&cmd, tpl, seg.timeline, workDir); err != nil {
+		return "", err
+	}
+	addText(&cmd, seg.timeline, seg.textPaths, tpl)
+
+	// Only the video, the audio is added when the segments are joined
+	cmd.Args = append(cmd.Args, "-an", "-t", secs(seg.Duration()))
+	cmd.Args = append(cmd.Args, r.videoEncoding()...)
+	cmd.MakeCommand("", "", false)
+
+	if err := r.runStage(ctx, "segment", &cmd, seg.Duration(), progress); err != nil {
+		os.Remove(tmp + ".mp4")
+		return "", err
+	}
+
+	if err := os.Rename(tmp+".mp4", path); err != nil {
+		os.Remove(tmp + ".mp4")
+		return "", err
+	}
+
+	return path, nil
+}
+
+// Remove the least recently used segments until they take up less than SegmentCacheMaxBytes.
+// Half rendered segments left behind by a crash are removed once they are a day old.
+func (r *Renderer) sweepSegments() {
+	entries, err := os.ReadDir(r.SegmentDir)
+	if err != nil {
+		slog.Error("reading segment cache", "error", err)
+		return
+	}
+
+	var segments []os.FileInfo
+	var total int64
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		if strings.HasSuffix(info.Name(), ".tmp.mp4") {
+			if time.Since(info.ModTime()) > 24*time.Hour {
+				os.Remove(filepath.Join(r.SegmentDir, info.Name()))
+			}
+			continue
+		}
+
+		segments = append(segments, info)
+		total += info.Size()
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].ModTime().Before(segments[j].ModTime())
+	})
+
+	for _, info := range segments {
+		if total <= r.SegmentCacheMaxBytes || time.Since(info.ModTime()) < SEGMENT_MIN_AGE {
+			break
+		}
+
+		if err := os.Remove(filepath.Join(r.SegmentDir, info.Name())); err != nil {
+			slog.Error("removing segment", "error", err)
+			continue
+		}
+		total -= info.Size()
+	}
+}
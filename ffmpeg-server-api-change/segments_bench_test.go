@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+// Rendered by the benchmarks: the long Atrieflimren video with a few sections
+const BENCH_REQUEST = `{"payload":[{"id":"Atrieflimren","parentOptions":[
+	{"name":"Symptomer","introduction":"Atrieflimren/3/introduction","options":[{"name":"Hjertebanken","audioName":"Atrieflimren/3/1","active":true,"delay":0.5}]},
+	{"name":"Behandling","audioName":"Atrieflimren/3/0"},
+	{"name":"Efter behandlingen","audioName":"Atrieflimren/3/2"}]}]}`
+
+// Render the request in a single pass, a segment at a time, and with the segments in parallel.
+// All of them encode the video the same way, see videoEncoding, so they only differ in how long they take.
+// Every render starts without cached segments, so every segment is encoded. Needs ffmpeg, ffprobe and the assets,
+// and is skipped without them: go test -run '^$' -bench Render -benchtime 1x
+func BenchmarkRender(b *testing.B) {
+	var renderer, request = benchRenderer(b)
+
+	for _, run := range []struct {
+		name      string
+		segmented bool
+		workers   int
+	}{
+		{"single pass", false, 0},
+		{"segments one at a time", true, 1},
+		{fmt.Sprintf("segments %d at a time", runtime.NumCPU()), true, runtime.NumCPU()},
+	} {
+		b.Run(run.name, func(b *testing.B) {
+			var r = *renderer
+			r.SegmentDir = ""
+			r.SegmentWorkers = run.workers
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+
+				// An empty cache of its own, so nothing rendered before is reused
+				if run.segmented {
+					r.SegmentDir = b.TempDir()
+				}
+
+				var id = fmt.Sprintf("bench-%d", i)
+				workDir, err := r.makeWorkDir(id)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.StartTimer()
+				err = r.GenerateVideo(context.Background(), workDir, id, request, nil)
+				b.StopTimer()
+
+				os.RemoveAll(workDir)
+				os.Remove(r.outputPath(id))
+
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// The renderer of the default config with BENCH_REQUEST, rendering into directories of the benchmark
+func benchRenderer(b *testing.B) (*Renderer, JSONObj) {
+	b.Helper()
+
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			b.Skipf("%s is not installed", tool)
+		}
+	}
+
+	var cfg = DefaultConfig()
+	cfg.OutputDir = b.TempDir()
+	cfg.WorkDir = b.TempDir()
+	cfg.SegmentDir = ""
+
+	renderer, err := loadRenderer(cfg)
+	if err != nil {
+		b.Skipf("the assets are missing: %v", err)
+	}
+
+	var request JSONObj
+	if err := json.Unmarshal([]byte(BENCH_REQUEST), &request); err != nil {
+		b.Fatal(err)
+	}
+
+	if err := ValidateRequest(&request, renderer); err != nil {
+		b.Skipf("the assets of the request are missing: %v", err)
+	}
+
+	return renderer, request
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"server/branding"
+)
+
+// A timeline with the intro, a section per duration with a single clip after PARENT_AUDIO_DELAY, and the outro
+func testTimeline(intro float64, sections []float64, outro float64) *Timeline {
+	var t = &Timeline{Intro: Span{Start: 0, End: intro}}
+
+	var cursor = intro
+	for _, duration := range sections {
+		var section = Section{Span: Span{Start: cursor, End: cursor + duration}}
+		section.Clips = []Clip{{Span: Span{Start: cursor + PARENT_AUDIO_DELAY, End: cursor + duration}}}
+		t.Sections = append(t.Sections, section)
+		cursor += duration
+	}
+
+	t.Outro = Span{Start: cursor, End: cursor + outro}
+	t.Duration = t.Outro.End
+
+	return t
+}
+
+// Write the title and text files of a section and return their path without the suffix
+func writeTestTexts(t *testing.T, dir string, name string, text string) string {
+	t.Helper()
+
+	var path = filepath.Join(dir, name)
+	for _, suffix := range []string{"-title.txt", "-text.txt"} {
+		if err := os.WriteFile(path+suffix, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+// A section is the same segment wherever it is in the video, so it's only rendered once
+func TestSectionKeyDoesNotDependOnPosition(t *testing.T) {
+	var dir = t.TempDir()
+	var tpl = &branding.Template{}
+	var first = writeTestTexts(t, dir, "first", "Symptomer")
+	var second = writeTestTexts(t, dir, "second", "Behandling")
+
+	// The same section on its own, and after another section
+	var alone = testTimeline(5, []float64{10}, 5).segments([]string{second})
+	var after = testTimeline(5, []float64{7.5, 10}, 5).segments([]string{first, second})
+
+	aloneKey, err := alone[1].key(tpl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterKey, err := after[2].key(tpl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aloneKey != afterKey {
+		t.Errorf("the section has key %s on its own and %s after another section", aloneKey, afterKey)
+	}
+	if after[2].Start != 12.5 || after[2].Source.Start != 5 {
+		t.Errorf("the section is at %v in the video and cut from %v, want 12.5 and 5", after[2].Start, after[2].Source.Start)
+	}
+
+	// So is the outro, however long the video before it is
+	aloneKey, _ = alone[2].key(tpl, nil)
+	afterKey, _ = after[3].key(tpl, nil)
+	if aloneKey != afterKey {
+		t.Errorf("the outro has key %s after one section and %s after two", aloneKey, afterKey)
+	}
+
+	// Another text is another segment
+	otherKey, _ := after[1].key(tpl, nil)
+	if otherKey == afterKey {
+		t.Error("sections with different texts have the same key")
+	}
+}
+
+// Every part is a whole number of frames and starts where the one before ends, the clips move along
+func TestOnFrames(t *testing.T) {
+	const frameRate = 25
+
+	var timeline = testTimeline(5, []float64{7.31, 10.017}, 4.99).onFrames(frameRate)
+
+	var end = 0.0
+	for _, span := range []Span{timeline.Intro, timeline.Sections[0].Span, timeline.Sections[1].Span, timeline.Outro} {
+		if span.Start != end {
+			t.Errorf("%v starts at %v, want %v", span, span.Start, end)
+		}
+
+		var frames = span.Duration() * frameRate
+		if math.Abs(frames-math.Round(frames)) > 1e-6 {
+			t.Errorf("%v is %v frames long", span, frames)
+		}
+
+		end = span.End
+	}
+
+	if timeline.Duration != end {
+		t.Errorf("duration %v, want %v", timeline.Duration, end)
+	}
+
+	var section = timeline.Sections[1]
+	if clip := section.Clips[0]; math.Abs(clip.Start-section.Start-PARENT_AUDIO_DELAY) > 1e-9 {
+		t.Errorf("the clip starts %v into its section, want %v", clip.Start-section.Start, PARENT_AUDIO_DELAY)
+	}
+}
@@ -1,48 +1,226 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/google/uuid"
 	"io"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+
+	"server/branding"
+	"server/catalog"
+	"server/probe"
 )
 
+// The defaults of the config, see Config
 const IO_DIR = "/usr/local/etc/"
 const ADDR = ":443"
 const DEBUGADDR = ":8080"
 
-func StartServer(debug bool) {
+// Only reachable from the machine itself, see Config.InternalAddr
+const INTERNAL_ADDR = "127.0.0.1:9090"
+
+// Number of videos rendered at the same time, and how many may wait in line
+const JOB_WORKERS = 2
+const JOB_QUEUE_SIZE = 64
+
+// Optional manifest with extra assets and their languages
+const CATALOG_MANIFEST = "catalog.json"
+
+// Branding templates, and the one used when a request doesn't pick one
+const TEMPLATE_DIR = "templates"
+const DEFAULT_TEMPLATE = "mit-hjerte"
+
+// How often an idle event stream gets a comment, so it isn't closed
+const SSE_KEEP_ALIVE = 15 * time.Second
+
+// On SIGTERM or SIGINT the running renders get this long to finish, the service manager must wait longer than this.
+// After them the open requests get HTTP_SHUTDOWN_TIMEOUT to finish.
+const SHUTDOWN_TIMEOUT = 5 * time.Minute
+const HTTP_SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// Start the API with the config, which must be valid. SIGHUP reloads the asset catalog.
+// Runs until SIGTERM or SIGINT, and then shuts down without losing a job: no new jobs are taken, the running renders
+// finish or are queued again, the open requests are answered and the job database is closed.
+func StartServer(cfg *Config) {
 	mux := http.NewServeMux()
 
-	startFileServer(mux)
+	renderer, err := loadRenderer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Share the CPUs between the jobs running at the same time
+	renderer.SegmentWorkers = max(1, runtime.NumCPU()/cfg.Workers)
+
+	store, err := OpenJobStore(cfg.JobDB)
+	if err != nil {
+		log.Fatal("Error opening job database: ", err)
+	}
+
+	var notifier = NewNotifier(cfg.CallbackURL, cfg.CallbackSecret, cfg.CallbackAllowPrivate)
+
+	jobs, err := NewJobManager(renderer, store, notifier, cfg)
+	if err != nil {
+		log.Fatal("Error loading jobs: ", err)
+	}
+
+	keys, err := OpenKeyStore(cfg.KeyDB)
+	if err != nil {
+		log.Fatal("Error opening API key database: ", err)
+	}
+
+	auth, err := NewAuth(cfg.RequireAPIKey, keys, store)
+	if err != nil {
+		log.Fatal("Error loading API key usage: ", err)
+	}
+
+	startFileServer(mux, cfg.VideoDir)
+
+	handleAPICall(mux, jobs, renderer, auth)
+	handleJobs(mux, jobs, auth)
+	handleCatalog(mux, renderer.Assets)
+	var health = NewHealth(cfg, renderer, jobs)
+	handleHealth(mux, health)
+
+	// What the server is doing isn't for the clients, it's served on an address of its own
+	var internal = http.NewServeMux()
+	handleDebugInfo(internal, health)
+	handleReadiness(internal, health)
+	handleMetrics(internal, jobs)
 
-	handleAPICall(mux)
+	srv := makeConfigs(mux, cfg)
 
-	srv := makeConfigs(mux, debug)
+	var serveErr = make(chan error, 2)
+
+	var internalSrv *http.Server
+	if cfg.InternalAddr != "" {
+		internalSrv = &http.Server{Addr: cfg.InternalAddr, Handler: logRequests(internal)}
+		go func() {
+			slog.Info("serving internal endpoints", "addr", cfg.InternalAddr)
+			serveErr <- internalSrv.ListenAndServe()
+		}()
+	}
 
 	// Start the server
-	if debug {
-		fmt.Println("\nDEBUG MODE\n\n--------\n\nPORT 80 ONLY\n\n--------")
-		log.Fatal(srv.ListenAndServe())
-	} else {
-		log.Fatal(srv.ListenAndServeTLS(
-			"/etc/letsencrypt/live/api.mit-hjerte.dk/fullchain.pem",
-			"/etc/letsencrypt/live/api.mit-hjerte.dk/privkey.pem"))
+	go func() {
+		if cfg.Debug {
+			slog.Warn("debug mode, plain HTTP only", "addr", cfg.DebugAddr)
+			serveErr <- srv.ListenAndServe()
+		} else {
+			serveErr <- srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		}
+	}()
+
+	// SIGHUP scans the asset directories again, for assets added while the server runs
+	var hangups = make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			if err := renderer.Assets.Reload(); err != nil {
+				slog.Error("reloading catalog", "error", err)
+			}
+		}
+	}()
+
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-signals.Done():
+	}
+
+	// A second signal kills the server right away
+	stop()
+	slog.Info("shutting down, send the signal again to stop right away")
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	if err := jobs.Shutdown(drainCtx); err != nil {
+		slog.Warn("renders stopped, they are rendered again after the restart", "after", time.Duration(cfg.ShutdownTimeout))
+	}
+	cancel()
+
+	httpCtx, cancel := context.WithTimeout(context.Background(), HTTP_SHUTDOWN_TIMEOUT)
+	if err := srv.Shutdown(httpCtx); err != nil {
+		slog.Error("shutting down HTTP server", "error", err)
+		srv.Close()
+	}
+	if internalSrv != nil {
+		internalSrv.Shutdown(httpCtx)
+	}
+	cancel()
+
+	if err := store.Close(); err != nil {
+		slog.Error("closing job database", "error", err)
+	}
+
+	slog.Info("server stopped")
+}
+
+// Load the asset catalog and the templates, and make the renderer that uses them
+func loadRenderer(cfg *Config) (*Renderer, error) {
+	// One prober for the catalog and every render, so files are only probed again when they change
+	prober := probe.New("ffprobe")
+
+	assets, err := catalog.Load(cfg.VideoDir, cfg.AudioDir, cfg.CatalogManifest, prober)
+	if err != nil {
+		return nil, fmt.Errorf("loading asset catalog: %w", err)
 	}
+
+	templates, err := branding.Load(cfg.TemplateDir)
+	if err != nil {
+		return nil, fmt.Errorf("loading templates: %w", err)
+	}
+	if _, ok := templates.Get(DEFAULT_TEMPLATE); !ok {
+		return nil, fmt.Errorf("default template is missing: %s", DEFAULT_TEMPLATE)
+	}
+
+	for _, dir := range []string{cfg.OutputDir, cfg.WorkDir, cfg.SegmentDir} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("making %s: %w", dir, err)
+		}
+	}
+
+	return &Renderer{
+		Assets:               assets,
+		Prober:               prober,
+		Templates:            templates,
+		StageTimeouts:        cfg.stageTimeouts(),
+		OutputDir:            cfg.OutputDir,
+		WorkDir:              cfg.WorkDir,
+		KeepFailedWorkDirs:   cfg.KeepFailedWorkDirs,
+		SegmentDir:           cfg.SegmentDir,
+		SegmentCacheMaxBytes: cfg.SegmentCacheMaxBytes,
+		Preset:               cfg.Preset,
+		CRF:                  cfg.CRF,
+	}, nil
 }
 
-func startFileServer(mux *http.ServeMux) {
-	videos := http.FileServer(http.Dir("./videos"))
+func startFileServer(mux *http.ServeMux, videoDir string) {
+	videos := http.FileServer(http.Dir(videoDir))
 
 	mux.Handle("/videos/", http.StripPrefix("/videos/", addHeaders(videos)))
 }
 
-func makeConfigs(mux *http.ServeMux, debug bool) *http.Server {
-	if !debug {
+func makeConfigs(mux *http.ServeMux, config *Config) *http.Server {
+	if !config.Debug {
 		cfg := &tls.Config{
 			MinVersion:               tls.VersionTLS12,
 			CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
@@ -57,59 +235,394 @@ func makeConfigs(mux *http.ServeMux, debug bool) *http.Server {
 
 		//Config server
 		return &http.Server{
-			Addr:         ADDR,
-			Handler:      mux,
+			Addr:         config.Addr,
+			Handler:      logRequests(instrumentHandler(mux)),
 			TLSConfig:    cfg,
 			TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
 		}
 	} else {
 		return &http.Server{
-			Addr:    DEBUGADDR,
-			Handler: mux,
+			Addr:    config.DebugAddr,
+			Handler: logRequests(instrumentHandler(mux)),
 		}
 	}
 }
 
-func handleAPICall(mux *http.ServeMux) {
+// Queue a video render and answer right away with the job, the render happens in the background.
+// With ?wait=true the answer waits for the render instead, and the render is canceled if the client goes away.
+func handleAPICall(mux *http.ServeMux, jobs *JobManager, renderer *Renderer, auth *Auth) {
 	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
 		// Read all the headers of the request and log them
 		// m := readAllHeaders(r)
 
 		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
 		w.Header().Add("Cache-Control", "no-cache, must-revalidate, proxy-revalidate")
-		w.Header().Add("Access-Control-Allow-Origin", "*")
+		if allowCORS(w, r) {
+			return
+		}
 
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusOK)
+		key, ok := auth.Check(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "only POST is allowed")
+			return
+		}
+
+		if !auth.Limit(w, key) {
+			return
+		}
 
 		var requestJSON JSONObj
 		decoder := json.NewDecoder(r.Body)
 
 		err := decoder.Decode(&requestJSON)
 
-		uuid := uuid.New()
+		if err != nil {
+			logFor(r.Context()).Info("invalid JSON", "error", err)
+			writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+			return
+		}
+
+		// Reject the request before any rendering if it can't be rendered
+		if err := ValidateRequest(&requestJSON, renderer); err != nil {
+			var body = errorBodyFrom(err)
+			writeJSON(w, body.Status, body)
+			return
+		}
 
+		// A client sending the same request again, after a dropped connection, gets the job it started the first time
+		var idempotencyKey = r.Header.Get("Idempotency-Key")
+		if len(idempotencyKey) > MAX_IDEMPOTENCY_KEY_LENGTH {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key must not be longer than %d characters", MAX_IDEMPOTENCY_KEY_LENGTH))
+			return
+		}
+
+		// Clients can't replay each other's jobs by sending the same Idempotency-Key
+		if idempotencyKey != "" && key.Id != "" {
+			idempotencyKey = key.Id + "/" + idempotencyKey
+		}
+
+		// Only new renders count against the quota, not the jobs that were asked for before, are in the cache
+		// or are being rendered for another request already
+		job, replayed, err := jobs.Submit(requestJSON, idempotencyKey, key.Id, func() error {
+			return auth.ChargeRender(key)
+		})
 		if err != nil {
-			fmt.Println("JSON Decode error:", err)
+			logFor(r.Context()).Warn("job not submitted", "key", key.Id, "error", err)
+		}
+
+		var quotaErr *QuotaError
+		if errors.As(err, &quotaErr) {
+			setRetryAfter(w, quotaErr.RetryAfter)
+			writeError(w, http.StatusTooManyRequests, err.Error())
 			return
+		}
+
+		if errors.Is(err, ErrIdempotencyMismatch) {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		// Too many renders waiting already, tell the client when to try again
+		if errors.Is(err, ErrQueueFull) {
+			var retryAfter = int(math.Ceil(jobs.RetryAfter().Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writeError(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+
+		logFor(r.Context()).Info("job submitted", "key", key.Id, "job", job.Id, "status", job.Status, "replayed", replayed)
+		job.EventsURL = auth.EventsURL(job.Id, key.Id)
+
+		// Tell the client where to poll for the result
+		w.Header().Set("Location", "/api/jobs/"+job.Id)
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+
+		if r.URL.Query().Get("wait") == "true" {
+			waitForJob(w, r, jobs, job.Id, key.Id)
+			return
+		}
+
+		// The same video was rendered before and is still in the cache
+		if job.Status == JobSucceeded {
+			writeJSON(w, http.StatusOK, job)
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, job)
+	})
+}
+
+// Report the status of a job, with the download URL or the error once it's done
+// /api/jobs/{id}/events streams its progress instead, /api/jobs/{id}/log serves its log.
+// Only the API keys that submitted a job can see it, to other keys it doesn't exist.
+func handleJobs(mux *http.ServeMux, jobs *JobManager, auth *Auth) {
+	mux.HandleFunc("/api/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.Header().Add("Cache-Control", "no-cache, must-revalidate, proxy-revalidate")
+		if allowCORS(w, r) {
+			return
+		}
+
+		// /api/jobs/{id}, /api/jobs/{id}/events or /api/jobs/{id}/log
+		id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/jobs/"), "/")
+
+		if sub != "" && sub != "events" && sub != "log" {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		// EventSource can't send the API key, a browser follows the progress with the token in the job's eventsUrl
+		var owner string
+		if sub == "events" && r.URL.Query().Has("token") {
+			var ok bool
+			if owner, ok = auth.CheckEventsToken(w, r, id); !ok {
+				return
+			}
 		} else {
-			fmt.Println("JSON Decode success")
+			key, ok := auth.Check(w, r)
+			if !ok {
+				return
+			}
+			owner = key.Id
+		}
 
-			// Get current date in format DD-MM-YYYY
-			date := time.Now().Format("02-01-2006")
+		switch {
+		case r.Method == http.MethodGet && sub == "events":
+			streamJobEvents(w, r, jobs, id, owner)
+
+		case r.Method == http.MethodGet && sub == "log":
+			serveJobLog(w, jobs, id, owner)
+
+		case r.Method == http.MethodGet && sub == "":
+			job, ok := jobs.Get(id, owner)
+			if !ok {
+				writeError(w, http.StatusNotFound, "job not found")
+				return
+			}
+			job.EventsURL = auth.EventsURL(job.Id, owner)
+
+			// Looking the job up worked, a failed job is told by its status and error, not the status code
+			writeJSON(w, http.StatusOK, job)
+
+		case r.Method == http.MethodDelete && sub == "":
+			job, err := jobs.Cancel(id, owner)
+
+			switch {
+			case errors.Is(err, ErrJobNotFound):
+				writeError(w, http.StatusNotFound, err.Error())
+			case errors.Is(err, ErrJobFinished):
+				writeError(w, http.StatusConflict, err.Error())
+			case job.Status == JobCanceled:
+				writeJSON(w, http.StatusOK, job)
+			default:
+				// Still running until ffmpeg has been killed, or for the other clients that asked for the same video
+				writeJSON(w, http.StatusAccepted, job)
+			}
+
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "only GET and DELETE are allowed")
+		}
+	})
+}
 
-			GenerateVideo("mit-hjerte-"+date+"-"+uuid.String(), requestJSON.Payload)
+// Answer with the log of the job, as far as it has come
+func serveJobLog(w http.ResponseWriter, jobs *JobManager, id string, owner string) {
+	path, ok := jobs.LogPath(id, owner)
+	if !ok {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
 
-			// Send a URL for downloading the file, to the client
-			response := "https://mit-hjerte.dk/download?url=" + "mit-hjerte-" + date + "-" + uuid.String() + "-final.mp4"
+	file, err := os.Open(path)
+	if err != nil {
+		// Not started yet, or the log was swept
+		writeError(w, http.StatusNotFound, "the job has no log")
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, file)
+}
+
+// Answer a request that waited for its render with the job, a failed job with the status code its error maps to,
+// as if the render had been done in the request
+func writeJob(w http.ResponseWriter, job Job) {
+	if job.Status == JobFailed && job.Error != nil {
+		writeJSON(w, job.Error.Status, job)
+		return
+	}
 
-			// Send video URL as response for use in front-end
-			w.Write([]byte(response))
+	writeJSON(w, http.StatusOK, job)
+}
+
+// Hold the request until the job has finished and answer with it.
+// If the client goes away first it lets go of the job, which is canceled if no other client wants the video.
+func waitForJob(w http.ResponseWriter, r *http.Request, jobs *JobManager, id string, owner string) {
+	_, updates, unsubscribe, ok := jobs.Subscribe(id, owner)
+	if !ok {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			logFor(r.Context()).Info("client went away, letting go of job", "job", id)
+			jobs.Cancel(id, owner)
+			return
+
+		// The job won't finish before the restart, the client can poll it afterwards
+		case <-jobs.Done():
+			writeError(w, http.StatusServiceUnavailable, "the server is restarting, the job is rendered after the restart")
+			return
+
+		case _, open := <-updates:
+			if !open {
+				job, _ := jobs.Get(id, owner)
+				writeJob(w, job)
+				return
+			}
 		}
+	}
+}
 
+// List the videos and audio clips that can be used in a request
+func handleCatalog(mux *http.ServeMux, assets *catalog.Catalog) {
+	mux.HandleFunc("/api/catalog", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.Header().Add("Cache-Control", "no-cache, must-revalidate, proxy-revalidate")
+		if allowCORS(w, r) {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, struct {
+			Videos []catalog.Asset `json:"videos"`
+			Audio  []catalog.Asset `json:"audio"`
+		}{
+			Videos: assets.Videos(),
+			Audio:  assets.AudioClips(),
+		})
 	})
 }
 
+// Send the progress of a job as Server-Sent Events until it has finished or the client goes away.
+// A "progress" event is sent for every update, and a single "done" event with the finished job at the end.
+func streamJobEvents(w http.ResponseWriter, r *http.Request, jobs *JobManager, id string, owner string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	job, updates, unsubscribe, ok := jobs.Subscribe(id, owner)
+	if !ok {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Don't let a proxy in front hold the events back
+	w.WriteHeader(http.StatusOK)
+
+	// Start the bar where the job is now
+	if job.Progress != nil {
+		writeEvent(w, "progress", job.Progress)
+	}
+	flusher.Flush()
+
+	// Comments keep proxies from closing a quiet connection while a job waits in the queue
+	keepAlive := time.NewTicker(SSE_KEEP_ALIVE)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		// Let the shutdown finish, the client reconnects after the restart
+		case <-jobs.Done():
+			return
+
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+
+		case progress, open := <-updates:
+			if !open {
+				job, _ = jobs.Get(id, owner)
+				writeEvent(w, "done", job)
+				flusher.Flush()
+				return
+			}
+
+			writeEvent(w, "progress", progress)
+			flusher.Flush()
+		}
+	}
+}
+
+// Write a single Server-Sent Event with v as JSON data
+func writeEvent(w io.Writer, event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("encoding JSON", "error", err)
+		return
+	}
+
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// Let web pages on any origin use the API. Browsers ask with an OPTIONS preflight before they send
+// the API key or an Idempotency-Key, which is answered here, and true is returned.
+func allowCORS(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Idempotent-Replayed, Retry-After, X-Request-Id")
+
+	if r.Method != http.MethodOptions {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, Authorization")
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// writeError is a helper function that sends an error message as a JSON error body
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorBody{Status: status, Error: message})
+}
+
+// writeJSON is a helper function that sends v to the client as JSON with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("encoding JSON", "error", err)
+	}
+}
+
 func HandleIndex(mux *http.ServeMux) {
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -121,8 +634,8 @@ func HandleIndex(mux *http.ServeMux) {
 		// The `readAllHeaders` function returns the headers as a map.
 		m := readAllHeaders(r)
 
-		// The `fmt.Println` function prints a string to the console.
-		fmt.Println("All Headers:", m)
+		// The headers are only logged at debug level
+		slog.Debug("all headers", "headers", m)
 
 		serveFile(w, r, "index.html")
 	})
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+
+	"server/branding"
+	"server/catalog"
+)
+
+// Delay before the first clip of a parent option, in seconds
+const PARENT_AUDIO_DELAY = 0.250
+
+// A span of time in the video, in seconds from the start
+type Span struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+func (s Span) Duration() float64 {
+	return s.End - s.Start
+}
+
+// An audio clip placed on the timeline
+type Clip struct {
+	Span
+	Asset catalog.Asset `json:"-"`
+}
+
+// Everything shown and heard for a single parent option.
+// The title and the bullet texts are shown for the whole span of the section.
+type Section struct {
+	Span
+	Option ParentOption `json:"-"`
+	Clips  []Clip       `json:"clips"`
+}
+
+// Timeline has the exact start and end of every part of the video.
+// Both the audio graph and the drawtext graph are made from it, so the text always follows the narration.
+type Timeline struct {
+	Video    catalog.Asset `json:"-"`
+	Intro    Span          `json:"intro"`
+	Sections []Section     `json:"sections"`
+	Outro    Span          `json:"outro"`
+	Duration float64       `json:"duration"`
+}
+
+// The span of a named part of the video: "intro", "sections" (everything between intro and outro) or "outro".
+// Returns false for the whole video.
+func (t *Timeline) window(name string) (Span, bool) {
+	switch name {
+	case "intro":
+		return t.Intro, true
+	case "sections":
+		return Span{Start: t.Intro.End, End: t.Outro.Start}, true
+	case "outro":
+		return t.Outro, true
+	default:
+		return Span{}, false
+	}
+}
+
+// Every audio clip in the order they are heard
+func (t *Timeline) Clips() []Clip {
+	var clips []Clip
+	for _, s := range t.Sections {
+		clips = append(clips, s.Clips...)
+	}
+	return clips
+}
+
+// Lay out the video: the intro, then a section per parent option with its clips one after another, then the outro.
+// The intro and outro last as long as the template says.
+// The lead clip of a section (the introduction, or else the option's own audio) starts after PARENT_AUDIO_DELAY,
+// every active sub option's clip after its own delay.
+func (r *Renderer) BuildTimeline(ctx context.Context, video VideoObj, tpl *branding.Template) (*Timeline, error) {
+	var videoName = video.Id + "_Long"
+
+	videoAsset, ok := r.Assets.Video(videoName)
+	if !ok {
+		return nil, &MissingAssetError{Path: "videos/" + videoName + catalog.VIDEO_EXT}
+	}
+
+	var t = &Timeline{
+		Video: videoAsset,
+		Intro: Span{Start: 0, End: tpl.Intro.Duration},
+	}
+
+	var cursor = t.Intro.End
+
+	// Put a clip on the timeline after the delay, and move the cursor to its end
+	var place = func(section *Section, name string, delay float64) error {
+		asset, duration, err := r.lookupAudio(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		var start = cursor + delay
+		section.Clips = append(section.Clips, Clip{
+			Span:  Span{Start: start, End: start + duration},
+			Asset: asset,
+		})
+		cursor = start + duration
+
+		return nil
+	}
+
+	for _, parentOpt := range video.ParentOptions {
+		var section = Section{Option: parentOpt}
+		section.Start = cursor
+
+		// The introduction replaces the option's own audio
+		var leadAudio = parentOpt.Introduction
+		if leadAudio == "" {
+			leadAudio = parentOpt.AudioName
+		}
+
+		if leadAudio != "" {
+			if err := place(&section, leadAudio, PARENT_AUDIO_DELAY); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, option := range parentOpt.Options {
+			if option.Active {
+				if err := place(&section, option.AudioName, option.Delay); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		section.End = cursor
+		t.Sections = append(t.Sections, section)
+	}
+
+	t.Outro = Span{Start: cursor, End: cursor + tpl.Outro.Duration}
+	t.Duration = t.Outro.End
+
+	return t, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"server/branding"
+	"server/catalog"
+	"server/probe"
+)
+
+// A renderer with the repo's templates and a catalog of the given assets, by name and length in seconds.
+// Names ending in _Long are videos, the rest audio. ffprobe is faked by a script that reads the length from the file.
+func newTestRenderer(t *testing.T, assets map[string]float64) *Renderer {
+	t.Helper()
+
+	var dir = t.TempDir()
+	var ffprobe = filepath.Join(dir, "ffprobe")
+	var script = "#!/bin/sh\nfor last; do :; done\necho '{\"format\":{\"duration\":\"'$(cat \"$last\")'\"}}'\n"
+	if err := os.WriteFile(ffprobe, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var videoDir = filepath.Join(dir, "videos")
+	var audioDir = filepath.Join(dir, "audio")
+	for _, d := range []string{videoDir, audioDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, duration := range assets {
+		var path = filepath.Join(audioDir, name+catalog.AUDIO_EXT)
+		if strings.HasSuffix(name, "_Long") {
+			path = filepath.Join(videoDir, name+catalog.VIDEO_EXT)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(strconv.FormatFloat(duration, 'f', -1, 64)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var prober = probe.New(ffprobe)
+	assetCatalog, err := catalog.Load(videoDir, audioDir, "", prober)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := branding.Load(TEMPLATE_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Renderer{Assets: assetCatalog, Prober: prober, Templates: templates}
+}
+
+// The mit-hjerte template, with the 5 second intro and outro of the original render
+func testTemplate(t *testing.T, r *Renderer) *branding.Template {
+	t.Helper()
+
+	tpl, ok := r.template("")
+	if !ok {
+		t.Fatal("no default template")
+	}
+	if tpl.Intro.Duration != 5 || tpl.Outro.Duration != 5 {
+		t.Fatalf("the intro and outro take %v and %v seconds, the offsets below expect 5", tpl.Intro.Duration, tpl.Outro.Duration)
+	}
+
+	return tpl
+}
+
+func spansEqual(a Span, b Span) bool {
+	return math.Abs(a.Start-b.Start) < 1e-9 && math.Abs(a.End-b.End) < 1e-9
+}
+
+// The offsets are worked out by hand the way the original render did: 5 seconds of intro, every lead clip after
+// PARENT_AUDIO_DELAY, every active sub option after its own delay, and 5 seconds of outro after the last clip
+func TestBuildTimeline(t *testing.T) {
+	var r = newTestRenderer(t, map[string]float64{
+		"Heart_Long":  600,
+		"a/intro":     3.5,
+		"a/lead":      2,
+		"a/option1":   4.25,
+		"a/option2":   1.5,
+		"b/lead":      6,
+		"rounded/odd": 1.23456,
+	})
+	var tpl = testTemplate(t, r)
+
+	for _, test := range []struct {
+		name     string
+		options  []ParentOption
+		sections []Span
+		clips    []Span
+		duration float64
+	}{
+		{
+			name:     "a single lead clip",
+			options:  []ParentOption{{AudioName: "b/lead"}},
+			sections: []Span{{5, 11.25}},
+			clips:    []Span{{5.25, 11.25}},
+			duration: 16.25,
+		},
+		{
+			// The introduction is played instead of the option's own audio
+			name:     "introduction and sub options",
+			options:  []ParentOption{{AudioName: "a/lead", Introduction: "a/intro", Options: []Option{{AudioName: "a/option1", Delay: 0.5, Active: true}, {AudioName: "a/option2", Delay: 1}}}},
+			sections: []Span{{5, 13.5}},
+			clips:    []Span{{5.25, 8.75}, {9.25, 13.5}},
+			duration: 18.5,
+		},
+		{
+			// Each section starts where the one before ends
+			name: "two sections",
+			options: []ParentOption{
+				{AudioName: "a/lead", Options: []Option{{AudioName: "a/option2", Delay: 0, Active: true}}},
+				{AudioName: "b/lead"},
+			},
+			sections: []Span{{5, 8.75}, {8.75, 15}},
+			clips:    []Span{{5.25, 7.25}, {7.25, 8.75}, {9, 15}},
+			duration: 20,
+		},
+		{
+			// Without audio a section has no clips and takes no time
+			name:     "option without audio",
+			options:  []ParentOption{{Name: "only a title"}, {AudioName: "b/lead"}},
+			sections: []Span{{5, 5}, {5, 11.25}},
+			clips:    []Span{{5.25, 11.25}},
+			duration: 16.25,
+		},
+		{
+			// Clip lengths are rounded to two decimals
+			name:     "rounded duration",
+			options:  []ParentOption{{AudioName: "rounded/odd"}},
+			sections: []Span{{5, 6.48}},
+			clips:    []Span{{5.25, 6.48}},
+			duration: 11.48,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			timeline, err := r.BuildTimeline(context.Background(), VideoObj{Id: "Heart", ParentOptions: test.options}, tpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !spansEqual(timeline.Intro, Span{0, 5}) {
+				t.Errorf("intro %v, want {0 5}", timeline.Intro)
+			}
+
+			if len(timeline.Sections) != len(test.sections) {
+				t.Fatalf("%d sections, want %d", len(timeline.Sections), len(test.sections))
+			}
+			for i, section := range timeline.Sections {
+				if !spansEqual(section.Span, test.sections[i]) {
+					t.Errorf("section %d: %v, want %v", i+1, section.Span, test.sections[i])
+				}
+			}
+
+			var clips = timeline.Clips()
+			if len(clips) != len(test.clips) {
+				t.Fatalf("%d clips, want %d", len(clips), len(test.clips))
+			}
+			for i, clip := range clips {
+				if !spansEqual(clip.Span, test.clips[i]) {
+					t.Errorf("clip %d: %v, want %v", i+1, clip.Span, test.clips[i])
+				}
+			}
+
+			var outro = Span{test.duration - 5, test.duration}
+			if !spansEqual(timeline.Outro, outro) || math.Abs(timeline.Duration-test.duration) > 1e-9 {
+				t.Errorf("outro %v and duration %v, want %v and %v", timeline.Outro, timeline.Duration, outro, test.duration)
+			}
+		})
+	}
+}
+
+func TestBuildTimelineMissingAsset(t *testing.T) {
+	var r = newTestRenderer(t, map[string]float64{"Heart_Long": 600})
+	var tpl = testTemplate(t, r)
+
+	var missing *MissingAssetError
+	for _, video := range []VideoObj{
+		{Id: "Unknown"},
+		{Id: "Heart", ParentOptions: []ParentOption{{AudioName: "unknown"}}},
+	} {
+		_, err := r.BuildTimeline(context.Background(), video, tpl)
+		if !errors.As(err, &missing) {
+			t.Errorf("%+v: error %v, want a MissingAssetError", video, err)
+		}
+	}
+}
+
+func TestTimelineWindow(t *testing.T) {
+	var timeline = &Timeline{Intro: Span{0, 5}, Outro: Span{20, 25}, Duration: 25}
+
+	for _, test := range []struct {
+		name string
+		span Span
+		ok   bool
+	}{
+		{"intro", Span{0, 5}, true},
+		{"sections", Span{5, 20}, true},
+		{"outro", Span{20, 25}, true},
+		{"video", Span{}, false},
+		{"", Span{}, false},
+	} {
+		span, ok := timeline.window(test.name)
+		if span != test.span || ok != test.ok {
+			t.Errorf("window %q: %v %v, want %v %v", test.name, span, ok, test.span, test.ok)
+		}
+	}
+}
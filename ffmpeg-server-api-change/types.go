@@ -1,7 +1,10 @@
 package main
 
 type JSONObj struct {
-	Payload []VideoObj `json:"payload"`
+	Payload  []VideoObj `json:"payload"`
+	Template string     `json:"template"` // Name of the branding template, the default template if empty
+	// Told with a POST when the video is ready or the render failed, the server's default callback if empty
+	CallbackURL string `json:"callbackUrl,omitempty"`
 }
 
 type VideoObj struct {
@@ -33,15 +36,6 @@ type Option struct {
 	Active    bool    `json:"active"`
 }
 
-// For internal use
-type SanitizedOption struct {
-	Id        int     `json:"id"`
-	Text      string  `json:"text"`
-	AudioName string  `json:"audioName"`
-	Duration  float64 `json:"duration"`
-	Delay     float64 `json:"delay"`
-}
-
 type OptionTxtFile struct {
 	Title string
 	Text  string
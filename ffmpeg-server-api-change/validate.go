@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"server/catalog"
+)
+
+// Limits for a single render request
+const MAX_VIDEOS = 1 // The base videos can't be combined, so one per request
+const MAX_PARENT_OPTIONS = 20
+const MAX_OPTIONS = 30 // Per parent option
+const MAX_TITLE_LENGTH = 120
+const MAX_TEXT_LENGTH = 400
+const MAX_ASSET_NAME_LENGTH = 200
+
+// A single problem with a field in the request
+type FieldProblem struct {
+	Field   string `json:"field"`
+	Problem string `json:"problem"`
+}
+
+// The request can't be rendered, every problem found is listed
+type ValidationError struct {
+	Problems []FieldProblem
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("request is invalid: %d problem(s)", len(e.Problems))
+}
+
+type validator struct {
+	renderer *Renderer
+	problems []FieldProblem
+}
+
+func (v *validator) add(field string, format string, args ...interface{}) {
+	v.problems = append(v.problems, FieldProblem{Field: field, Problem: fmt.Sprintf(format, args...)})
+}
+
+// Check the request against the asset catalog and the templates before any ffmpeg work starts.
+// Returns a ValidationError listing every problem, or nil if the request can be rendered.
+func ValidateRequest(req *JSONObj, renderer *Renderer) error {
+	var v = validator{renderer: renderer}
+
+	if _, ok := renderer.template(req.Template); !ok {
+		v.add("template", "unknown template %q", req.Template)
+	}
+
+	if len(req.Payload) == 0 {
+		v.add("payload", "must contain a video")
+	}
+	if len(req.Payload) > MAX_VIDEOS {
+		v.add("payload", "must not contain more than %d video(s)", MAX_VIDEOS)
+	}
+
+	for i, video := range req.Payload {
+		v.validateVideo(fmt.Sprintf("payload[%d]", i), &video)
+	}
+
+	if req.CallbackURL != "" && !validCallbackURL(req.CallbackURL) {
+		v.add("callbackUrl", "must be an absolute http or https URL")
+	}
+
+	// Only a request with every asset in place can be laid out
+	if len(v.problems) == 0 {
+		for i, video := range req.Payload {
+			if err := v.fitsVideo(fmt.Sprintf("payload[%d]", i), video, req.Template); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+
+	return nil
+}
+
+// The intro, the narration and the outro must fit in the base video, it isn't looped or stretched.
+// A single pass render would cut the narration short, and a segment past the end can't be rendered.
+// Returns the error if the timeline can't be built, e.g. an audio clip can't be probed.
+func (v *validator) fitsVideo(field string, video VideoObj, templateName string) error {
+	tpl, _ := v.renderer.template(templateName)
+
+	timeline, err := v.renderer.BuildTimeline(context.Background(), video, tpl)
+	if err != nil {
+		return err
+	}
+
+	// An unknown length is left to ffmpeg
+	if timeline.Video.Duration > 0 && timeline.Duration > timeline.Video.Duration {
+		v.add(field, "the video is %.2f seconds long, but the intro, the audio and the outro take %.2f seconds", timeline.Video.Duration, timeline.Duration)
+	}
+
+	return nil
+}
+
+func (v *validator) validateVideo(field string, video *VideoObj) {
+	if v.assetName(field+".id", video.Id) {
+		v.assetExists(field+".id", catalog.Video, video.Id+"_Long")
+	}
+
+	if len(video.ParentOptions) == 0 {
+		v.add(field+".parentOptions", "must contain at least one option")
+	}
+	if len(video.ParentOptions) > MAX_PARENT_OPTIONS {
+		v.add(field+".parentOptions", "must not contain more than %d options", MAX_PARENT_OPTIONS)
+	}
+
+	for i, parentOpt := range video.ParentOptions {
+		v.validateParentOption(fmt.Sprintf("%s.parentOptions[%d]", field, i), &parentOpt)
+	}
+}
+
+func (v *validator) validateParentOption(field string, parentOpt *ParentOption) {
+	v.text(field+".name", parentOpt.Name, MAX_TITLE_LENGTH)
+	v.text(field+".description", parentOpt.Description, MAX_TEXT_LENGTH)
+
+	// The introduction is used instead of the audio when it's set
+	if parentOpt.Introduction != "" {
+		if v.assetName(field+".introduction", parentOpt.Introduction) {
+			v.assetExists(field+".introduction", catalog.Audio, parentOpt.Introduction)
+		}
+	} else if parentOpt.AudioName != "" {
+		if v.assetName(field+".audioName", parentOpt.AudioName) {
+			v.assetExists(field+".audioName", catalog.Audio, parentOpt.AudioName)
+		}
+	}
+
+	if len(parentOpt.Options) > MAX_OPTIONS {
+		v.add(field+".options", "must not contain more than %d options", MAX_OPTIONS)
+	}
+
+	for i, option := range parentOpt.Options {
+		var optField = fmt.Sprintf("%s.options[%d]", field, i)
+
+		v.text(optField+".name", option.Name, MAX_TEXT_LENGTH)
+
+		if option.Delay < 0 || option.Delay > 10 {
+			v.add(optField+".delay", "must be between 0 and 10 seconds")
+		}
+
+		// Only the active options are rendered, so only they need audio
+		if !option.Active {
+			continue
+		}
+
+		if option.AudioName == "" {
+			v.add(optField+".audioName", "is required for an active option")
+		} else if v.assetName(optField+".audioName", option.AudioName) {
+			v.assetExists(optField+".audioName", catalog.Audio, option.AudioName)
+		}
+	}
+}
+
+// Check text shown in the video: not too long and only printable characters on a single line
+func (v *validator) text(field string, text string, maxLength int) {
+	if !utf8.ValidString(text) {
+		v.add(field, "must be valid UTF-8")
+		return
+	}
+
+	if utf8.RuneCountInString(text) > maxLength {
+		v.add(field, "must not be longer than %d characters", maxLength)
+	}
+
+	for _, r := range text {
+		if !unicode.IsPrint(r) {
+			v.add(field, "contains a character that is not allowed: %q", r)
+			return
+		}
+	}
+}
+
+// Check the name of an audio or video asset, it's a path relative to the asset directory without extension.
+// Returns true if the name is well formed.
+func (v *validator) assetName(field string, name string) bool {
+	if name == "" {
+		v.add(field, "is required")
+		return false
+	}
+
+	if len(name) > MAX_ASSET_NAME_LENGTH {
+		v.add(field, "must not be longer than %d characters", MAX_ASSET_NAME_LENGTH)
+		return false
+	}
+
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			v.add(field, "must be a relative name without empty, . or .. path segments")
+			return false
+		}
+	}
+
+	for _, r := range name {
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(" _-.,/", r)) {
+			v.add(field, "contains a character that is not allowed: %q", r)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (v *validator) assetExists(field string, kind catalog.Kind, name string) {
+	var ok bool
+	if kind == catalog.Video {
+		_, ok = v.renderer.Assets.Video(name)
+	} else {
+		_, ok = v.renderer.Assets.Audio(name)
+	}
+
+	if !ok {
+		v.add(field, "unknown %s %q", kind, name)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// The problems ValidateRequest finds in the request, nil if it's valid
+func validationProblems(t *testing.T, r *Renderer, request JSONObj) map[string]string {
+	t.Helper()
+
+	var err = ValidateRequest(&request, r)
+	if err == nil {
+		return nil
+	}
+
+	var validation *ValidationError
+	if !errors.As(err, &validation) {
+		t.Fatalf("error %v, want a ValidationError", err)
+	}
+
+	var problems = make(map[string]string)
+	for _, p := range validation.Problems {
+		problems[p.Field] = p.Problem
+	}
+	return problems
+}
+
+func TestValidateRequest(t *testing.T) {
+	var r = newTestRenderer(t, map[string]float64{
+		"Heart_Long":   60,
+		"Short_Long":   12,
+		"heart/intro":  3.5,
+		"heart/option": 2,
+	})
+
+	// A valid request with a parent option, changed by each test
+	var valid = func() JSONObj {
+		return JSONObj{Payload: []VideoObj{{
+			Id: "Heart",
+			ParentOptions: []ParentOption{{
+				Name:         "Symptomer",
+				Description:  "Hvad du kan mærke",
+				Introduction: "heart/intro",
+				Options:      []Option{{Name: "Hjertebanken", AudioName: "heart/option", Delay: 0.5, Active: true}},
+			}},
+		}}}
+	}
+
+	if problems := validationProblems(t, r, valid()); problems != nil {
+		t.Fatalf("the valid request has problems: %v", problems)
+	}
+
+	for _, test := range []struct {
+		name    string
+		change  func(req *JSONObj)
+		field   string
+		problem string // Part of the problem that must be reported
+	}{
+		{"unknown template", func(req *JSONObj) { req.Template = "other" }, "template", "unknown template"},
+		{"no video", func(req *JSONObj) { req.Payload = nil }, "payload", "must contain a video"},
+		{"two videos", func(req *JSONObj) { req.Payload = append(req.Payload, req.Payload[0]) }, "payload", "more than 1"},
+		{"unknown video", func(req *JSONObj) { req.Payload[0].Id = "Lungs" }, "payload[0].id", "unknown video"},
+		{"no options", func(req *JSONObj) { req.Payload[0].ParentOptions = nil }, "payload[0].parentOptions", "at least one"},
+		{"callback", func(req *JSONObj) { req.CallbackURL = "ftp://example.com" }, "callbackUrl", "http or https"},
+		{
+			"title too long",
+			func(req *JSONObj) { req.Payload[0].ParentOptions[0].Name = strings.Repeat("a", MAX_TITLE_LENGTH+1) },
+			"payload[0].parentOptions[0].name", "longer than",
+		},
+		{
+			"control character in text",
+			func(req *JSONObj) { req.Payload[0].ParentOptions[0].Description = "line\nbreak" },
+			"payload[0].parentOptions[0].description", "not allowed",
+		},
+		{
+			"invalid UTF-8",
+			func(req *JSONObj) { req.Payload[0].ParentOptions[0].Name = "\xff" },
+			"payload[0].parentOptions[0].name", "UTF-8",
+		},
+		{
+			"unknown introduction",
+			func(req *JSONObj) { req.Payload[0].ParentOptions[0].Introduction = "heart/missing" },
+			"payload[0].parentOptions[0].introduction", "unknown audio",
+		},
+		{
+			"delay out of range",
+			func(req *JSONObj) { req.Payload[0].ParentOptions[0].Options[0].Delay = 11 },
+			"payload[0].parentOptions[0].options[0].delay", "between 0 and 10",
+		},
+		{
+			"active option without audio",
+			func(req *JSONObj) { req.Payload[0].ParentOptions[0].Options[0].AudioName = "" },
+			"payload[0].parentOptions[0].options[0].audioName", "required",
+		},
+		{
+			// Only the lead audio and the active options are rendered
+			"audio name is ignored with an introduction",
+			func(req *JSONObj) {
+				req.Payload[0].ParentOptions[0].AudioName = "../secret"
+				req.Payload[0].ParentOptions[0].Options = append(req.Payload[0].ParentOptions[0].Options, Option{AudioName: "missing"})
+			},
+			"", "",
+		},
+		{
+			"too long for the video",
+			func(req *JSONObj) { req.Payload[0].Id = "Short" },
+			"payload[0]", "the video is 12.00 seconds long, but the intro, the audio and the outro take 16.25 seconds",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var req = valid()
+			test.change(&req)
+
+			var problems = validationProblems(t, r, req)
+			if test.field == "" {
+				if problems != nil {
+					t.Fatalf("problems %v, want none", problems)
+				}
+				return
+			}
+
+			problem, ok := problems[test.field]
+			if !ok || !strings.Contains(problem, test.problem) {
+				t.Errorf("problems %v, want %s: ...%s...", problems, test.field, test.problem)
+			}
+		})
+	}
+}
+
+// Every problem is reported at once, not only the first
+func TestValidateRequestListsEveryProblem(t *testing.T) {
+	var r = newTestRenderer(t, map[string]float64{"Heart_Long": 60})
+
+	var problems = validationProblems(t, r, JSONObj{
+		Template: "other",
+		Payload: []VideoObj{{Id: "Heart", ParentOptions: []ParentOption{
+			{AudioName: "a/missing"},
+			{AudioName: "b/missing", Options: []Option{{Delay: -1}}},
+		}}},
+	})
+
+	for _, field := range []string{
+		"template",
+		"payload[0].parentOptions[0].audioName",
+		"payload[0].parentOptions[1].audioName",
+		"payload[0].parentOptions[1].options[0].delay",
+	} {
+		if _, ok := problems[field]; !ok {
+			t.Errorf("no problem with %s in %v", field, problems)
+		}
+	}
+}
+
+func TestAssetName(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		ok      bool
+		problem string
+	}{
+		{"Atrieflimren/3/introduction", true, ""},
+		{"Åreforkalkning/1, del 2.v2", true, ""},
+		{"", false, "is required"},
+		{strings.Repeat("a", MAX_ASSET_NAME_LENGTH+1), false, "longer than"},
+		{"../etc/passwd", false, "path segments"},
+		{"/absolute", false, "path segments"},
+		{"a//b", false, "path segments"},
+		{"a/./b", false, "path segments"},
+		{"a/b/", false, "path segments"},
+		{"a'b", false, "not allowed"},
+		{"a:b", false, "not allowed"},
+		{"a\\b", false, "not allowed"},
+		{"a\nb", false, "not allowed"},
+		{"a;rm -rf", false, "not allowed"},
+	} {
+		var v validator
+		var ok = v.assetName("field", test.name)
+
+		if ok != test.ok {
+			t.Errorf("%q: ok %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if !ok && (len(v.problems) != 1 || !strings.Contains(v.problems[0].Problem, test.problem)) {
+			t.Errorf("%q: problems %v, want one with %q", test.name, v.problems, test.problem)
+		}
+	}
+}
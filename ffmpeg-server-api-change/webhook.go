@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How many times a callback is tried before it is given up, and how long to wait before the second try.
+// The wait doubles after every failed try, up to CALLBACK_MAX_BACKOFF.
+const CALLBACK_ATTEMPTS = 8
+const CALLBACK_BACKOFF = 5 * time.Second
+const CALLBACK_MAX_BACKOFF = 10 * time.Minute
+
+// How long a receiver gets to answer a single callback
+const CALLBACK_TIMEOUT = 10 * time.Second
+
+// Returned when a callback URL leads to the server's own network, see publicOnly
+var ErrPrivateCallback = errors.New("callbacks to loopback, link-local and private addresses are not allowed")
+
+// Shared address space of carrier-grade NAT, not covered by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Sent to the callback URL of a job when it finishes
+type CallbackEvent struct {
+	Event      string     `json:"event"` // job.succeeded, job.failed or job.canceled
+	JobId      string     `json:"jobId"`
+	Status     JobStatus  `json:"status"`
+	URL        string     `json:"url,omitempty"`
+	Duration   float64    `json:"duration,omitempty"` // How long the render took, in seconds
+	Error      *errorBody `json:"error,omitempty"`
+	FinishedAt time.Time  `json:"finishedAt"`
+}
+
+func callbackEvent(job *Job) CallbackEvent {
+	var event = CallbackEvent{
+		Event:  "job." + string(job.Status),
+		JobId:  job.Id,
+		Status: job.Status,
+		URL:    job.URL,
+		Error:  job.Error,
+	}
+
+	if job.FinishedAt != nil {
+		event.FinishedAt = *job.FinishedAt
+		if job.StartedAt != nil {
+			event.Duration = job.FinishedAt.Sub(*job.StartedAt).Seconds()
+		}
+	}
+
+	return event
+}
+
+// Notifier POSTs a CallbackEvent to the callback URL of a job when it finishes.
+// Callbacks that haven't been delivered when it's stopped are left to the job manager to send again after the restart.
+// The receiver can check the X-Webhook-Signature header: "sha256=" and the hex HMAC-SHA256 of
+// the X-Webhook-Timestamp header, a dot and the body, with the shared secret as key.
+type Notifier struct {
+	DefaultURL string // Told about every job whose request has no callbackUrl, none if empty
+	secret     []byte
+	client     *http.Client
+
+	// CALLBACK_ATTEMPTS, CALLBACK_BACKOFF and CALLBACK_TIMEOUT, shorter in tests
+	attempts int
+	backoff  time.Duration
+	timeout  time.Duration
+
+	stop     chan struct{}  // Closed by Stop, deliveries waiting to be tried again give up
+	inflight sync.WaitGroup // Done when every delivery has given up or is over
+}
+
+// Unless allowPrivate is set, callbacks are only sent to public addresses, so a request can't make the server
+// call into its own network. It's checked when connecting, after DNS and on every redirect.
+func NewNotifier(defaultURL string, secret string, allowPrivate bool) *Notifier {
+	if secret == "" {
+		slog.Warn("callbackSecret is not set, callbacks are not signed")
+	}
+
+	var dialer = &net.Dialer{Timeout: CALLBACK_TIMEOUT}
+	var transport = http.DefaultTransport.(*http.Transport).Clone()
+	if !allowPrivate {
+		dialer.Control = publicOnly
+		// A proxy would connect for us, and it's usually on the private network itself
+		transport.Proxy = nil
+	}
+	transport.DialContext = dialer.DialContext
+
+	return &Notifier{
+		DefaultURL: defaultURL,
+		secret:     []byte(secret),
+		client:     &http.Client{Transport: transport},
+		attempts:   CALLBACK_ATTEMPTS,
+		backoff:    CALLBACK_BACKOFF,
+		timeout:    CALLBACK_TIMEOUT,
+		stop:       make(chan struct{}),
+	}
+}
+
+// Refuse to connect to anything but a public address, for net.Dialer.Control
+func publicOnly(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	var ip = net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateCallback, host)
+	}
+
+	return nil
+}
+
+// Send the event to the URL in the background, trying again with a growing wait until the receiver takes it.
+// done is called once the callback was delivered or given up on, not when the notifier was stopped first.
+func (n *Notifier) Notify(callbackURL string, event CallbackEvent, done func()) {
+	select {
+	case <-n.stop:
+		slog.Warn("callback left for after the restart", "job", event.JobId, "url", callbackURL)
+		return
+	default:
+	}
+
+	n.inflight.Add(1)
+	go func() {
+		defer n.inflight.Done()
+
+		body, err := json.Marshal(event)
+		if err != nil {
+			slog.Error("encoding callback", "job", event.JobId, "error", err)
+			done()
+			return
+		}
+
+		if n.deliver(callbackURL, event.JobId, body) {
+			done()
+		}
+	}()
+}
+
+// Stop the deliveries that wait to try again and wait for the ones that are being sent, for the shutdown
+func (n *Notifier) Stop() {
+	close(n.stop)
+	n.inflight.Wait()
+}
+
+// POST the body until the receiver takes it. Returns false if the notifier was stopped before it was delivered or given up on.
+func (n *Notifier) deliver(callbackURL string, jobId string, body []byte) bool {
+	var logger = slog.With("job", jobId, "url", callbackURL)
+	var backoff = n.backoff
+
+	for attempt := 1; attempt <= n.attempts; attempt++ {
+		retry, err := n.post(callbackURL, jobId, body)
+		if err == nil {
+			logger.Info("callback delivered", "attempt", attempt)
+			return true
+		}
+
+		logger.Warn("callback failed", "attempt", attempt, "attempts", n.attempts, "error", err)
+		if !retry || attempt == n.attempts {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-n.stop:
+			logger.Warn("callback left for after the restart", "attempt", attempt)
+			return false
+		}
+		backoff = min(backoff*2, CALLBACK_MAX_BACKOFF)
+	}
+
+	logger.Error("giving up on callback")
+	return true
+}
+
+// POST the body once. retry is false when trying again won't help, the receiver turned the callback down.
+func (n *Notifier) post(callbackURL string, jobId string, body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	// A fresh timestamp on every try, so receivers can turn away old replayed callbacks
+	var timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mit-hjerte-render")
+	req.Header.Set("X-Webhook-Id", jobId) // The same on every try, so receivers can drop repeats
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	if len(n.secret) > 0 {
+		req.Header.Set("X-Webhook-Signature", "sha256="+n.sign(timestamp, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return !errors.Is(err, ErrPrivateCallback), err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	// Server errors, timeouts and rate limits may pass, other client errors won't
+	var retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, fmt.Errorf("receiver answered %s", resp.Status)
+}
+
+func (n *Notifier) sign(timestamp string, body []byte) string {
+	var mac = hmac.New(sha256.New, n.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// A callback URL must be absolute and use http or https
+func validCallbackURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// The URL the request wants to be told at, or the default. Empty if there is none.
+func (m *JobManager) callbackFor(request JSONObj) string {
+	if request.CallbackURL != "" {
+		return request.CallbackURL
+	}
+
+	return m.notifier.DefaultURL
+}
+
+// Tell the job's callback URLs, or only the given ones, that it has finished. Must be called with the lock held.
+// The URLs are saved with the job until they have taken the callback, so a restart doesn't lose them.
+func (m *JobManager) notify(job *Job, urls ...string) {
+	if len(urls) == 0 {
+		urls = job.callbacks
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	for _, u := range urls {
+		if !slices.Contains(job.undelivered, u) {
+			job.undelivered = append(job.undelivered, u)
+		}
+
+		m.notifier.Notify(u, callbackEvent(job), func() {
+			m.update(job, func(j *Job) {
+				j.undelivered = slices.DeleteFunc(j.undelivered, func(v string) bool { return v == u })
+				m.save(j)
+			})
+		})
+	}
+
+	m.save(job)
+}
+
+// Add a callback URL to a job that another request is sharing. If the job has already finished,
+// the URL is told right away. Must be called with the lock held.
+func (m *JobManager) addCallback(job *Job, callbackURL string) {
+	if callbackURL == "" {
+		return
+	}
+
+	if job.finished() {
+		m.notify(job, callbackURL)
+		return
+	}
+
+	for _, u := range job.callbacks {
+		if u == callbackURL {
+			return
+		}
+	}
+
+	job.callbacks = append(job.callbacks, callbackURL)
+	m.save(job)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"server/branding"
+)
+
+// A receiver that answers every callback with the next of its statuses, 200 after the last,
+// or holds it for hold first. Every callback it gets is kept.
+type testReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	hold     time.Duration
+	calls    []receivedCallback
+}
+
+type receivedCallback struct {
+	at     time.Time
+	header http.Header
+	body   []byte
+}
+
+func (rc *testReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rc.mu.Lock()
+	rc.calls = append(rc.calls, receivedCallback{at: time.Now(), header: r.Header.Clone(), body: body})
+	var status = http.StatusOK
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	var hold = rc.hold
+	rc.hold = 0
+	rc.mu.Unlock()
+
+	if hold > 0 {
+		select {
+		case <-time.After(hold):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.WriteHeader(status)
+}
+
+func (rc *testReceiver) received() []receivedCallback {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return append([]receivedCallback(nil), rc.calls...)
+}
+
+// A notifier for receivers on loopback, with short waits
+func newTestNotifier(secret string) *Notifier {
+	var n = NewNotifier("", secret, true)
+	n.attempts = 4
+	n.backoff = 20 * time.Millisecond
+	n.timeout = 100 * time.Millisecond
+	return n
+}
+
+func TestCallbackSignature(t *testing.T) {
+	var receiver = &testReceiver{}
+	var server = httptest.NewServer(receiver)
+	defer server.Close()
+
+	var body = []byte(`{"event":"job.succeeded","jobId":"job"}`)
+	newTestNotifier("s3cret").deliver(server.URL, "job", body)
+
+	var calls = receiver.received()
+	if len(calls) != 1 {
+		t.Fatalf("got %d callbacks, want 1", len(calls))
+	}
+
+	var call = calls[0]
+	if string(call.body) != string(body) {
+		t.Errorf("body %s, want %s", call.body, body)
+	}
+	if id := call.header.Get("X-Webhook-Id"); id != "job" {
+		t.Errorf("X-Webhook-Id %q, want job", id)
+	}
+
+	// What a receiver does to check the callback
+	var mac = hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(call.header.Get("X-Webhook-Timestamp") + "." + string(call.body)))
+	var want = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := call.header.Get("X-Webhook-Signature"); got != want {
+		t.Errorf("X-Webhook-Signature %q, want %q", got, want)
+	}
+}
+
+func TestCallbackWithoutSecretIsNotSigned(t *testing.T) {
+	var receiver = &testReceiver{}
+	var server = httptest.NewServer(receiver)
+	defer server.Close()
+
+	newTestNotifier("").deliver(server.URL, "job", []byte(`{}`))
+
+	var calls = receiver.received()
+	if len(calls) != 1 || calls[0].header.Get("X-Webhook-Signature") != "" {
+		t.Fatalf("got %d callbacks, want 1 without a signature", len(calls))
+	}
+}
+
+// Server errors are tried again, waiting twice as long every time
+func TestCallbackRetriesServerErrors(t *testing.T) {
+	var receiver = &testReceiver{statuses: []int{http.StatusInternalServerError, http.StatusServiceUnavailable}}
+	var server = httptest.NewServer(receiver)
+	defer server.Close()
+
+	var n = newTestNotifier("s3cret")
+	n.deliver(server.URL, "job", []byte(`{}`))
+
+	var calls = receiver.received()
+	if len(calls) != 3 {
+		t.Fatalf("got %d callbacks, want 3", len(calls))
+	}
+
+	if wait := calls[1].at.Sub(calls[0].at); wait < n.backoff {
+		t.Errorf("waited %s before the second try, want at least %s", wait, n.backoff)
+	}
+	if wait := calls[2].at.Sub(calls[1].at); wait < 2*n.backoff {
+		t.Errorf("waited %s before the third try, want at least %s", wait, 2*n.backoff)
+	}
+
+	// Every try is signed again with its own timestamp
+	for i, call := range calls {
+		if call.header.Get("X-Webhook-Signature") == "" {
+			t.Errorf("try %d isn't signed", i+1)
+		}
+	}
+}
+
+// A receiver that doesn't answer in time is tried again
+func TestCallbackRetriesTimeouts(t *testing.T) {
+	var receiver = &testReceiver{hold: time.Second}
+	var server = httptest.NewServer(receiver)
+	defer server.Close()
+
+	newTestNotifier("").deliver(server.URL, "job", []byte(`{}`))
+
+	if calls := receiver.received(); len(calls) != 2 {
+		t.Fatalf("got %d callbacks, want 2", len(calls))
+	}
+}
+
+// A receiver that turns the callback down isn't asked again, one that keeps failing is given up on
+func TestCallbackGivesUp(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		statuses []int
+		want     int
+	}{
+		{"client error", []int{http.StatusBadRequest}, 1},
+		{"rate limited", []int{http.StatusTooManyRequests, http.StatusOK}, 2},
+		{"keeps failing", []int{500, 500, 500, 500, 500}, 4},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var receiver = &testReceiver{statuses: test.statuses}
+			var server = httptest.NewServer(receiver)
+			defer server.Close()
+
+			newTestNotifier("").deliver(server.URL, "job", []byte(`{}`))
+
+			if calls := receiver.received(); len(calls) != test.want {
+				t.Fatalf("got %d callbacks, want %d", len(calls), test.want)
+			}
+		})
+	}
+}
+
+// Without callbackAllowPrivate the server's own network can't be called
+func TestCallbackRefusesPrivateAddresses(t *testing.T) {
+	var receiver = &testReceiver{}
+	var server = httptest.NewServer(receiver)
+	defer server.Close()
+
+	var n = NewNotifier("", "", false)
+	retry, err := n.post(server.URL, "job", []byte(`{}`))
+
+	if !errors.Is(err, ErrPrivateCallback) || retry {
+		t.Fatalf("retry %v, error %v, want %v without retrying", retry, err, ErrPrivateCallback)
+	}
+	if calls := receiver.received(); len(calls) != 0 {
+		t.Fatalf("got %d callbacks, want none", len(calls))
+	}
+}
+
+// A callback still waiting to be tried again at the shutdown is kept with the job and sent after the restart
+func TestUndeliveredCallbackSentAfterRestart(t *testing.T) {
+	var receiver = &testReceiver{statuses: []int{http.StatusServiceUnavailable}}
+	var server = httptest.NewServer(receiver)
+	defer server.Close()
+
+	var path = filepath.Join(t.TempDir(), JOB_DB)
+	var cfg = DefaultConfig()
+	cfg.Workers = 0
+	cfg.LogDir = t.TempDir()
+
+	// A server start with the jobs stored by the one before
+	var start = func(n *Notifier) (*JobManager, *JobStore) {
+		store, err := OpenJobStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jobs, err := NewJobManager(&Renderer{Templates: &branding.Registry{}}, store, n, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jobs, store
+	}
+
+	var waitFor = func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("gave up waiting for %s", what)
+			}
+		}
+	}
+
+	// Waits an hour before it tries again, the shutdown comes first
+	var slow = newTestNotifier("")
+	slow.backoff = time.Hour
+
+	jobs, store := start(slow)
+	job, _, err := jobs.Submit(JSONObj{Template: "test", CallbackURL: server.URL}, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobs.Cancel(job.Id, ""); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the first try", func() bool { return len(receiver.received()) == 1 })
+
+	jobs.Shutdown(context.Background())
+	store.Close()
+
+	jobs, store = start(newTestNotifier(""))
+	waitFor("the callback after the restart", func() bool { return len(receiver.received()) == 2 })
+
+	var call = receiver.received()[1]
+	if call.header.Get("X-Webhook-Id") != job.Id || !strings.Contains(string(call.body), `"event":"job.canceled"`) {
+		t.Errorf("callback after the restart: id %s, body %s, want the canceled job %s", call.header.Get("X-Webhook-Id"), call.body, job.Id)
+	}
+
+	// Once it's taken it isn't sent again
+	jobs.Shutdown(context.Background())
+	stored, err := store.Load()
+	store.Close()
+	if err != nil || len(stored) != 1 || len(stored[0].undelivered) != 0 {
+		t.Fatalf("stored jobs %v, error %v, want the job without undelivered callbacks", stored, err)
+	}
+}
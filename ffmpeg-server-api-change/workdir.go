@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// Every render gets its own scratch directory in here, unless configured otherwise
+const WORK_DIR = "work"
+
+// Make an empty scratch directory for the job with the given id
+func (r *Renderer) makeWorkDir(id string) (string, error) {
+	var dir = filepath.Join(r.WorkDir, id)
+
+	// Left over from an earlier attempt, start over
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// Remove the scratch directory once the job is done, unless it failed and we keep those
+func (r *Renderer) cleanupWorkDir(ctx context.Context, dir string, failed bool) {
+	if failed && r.KeepFailedWorkDirs {
+		logFor(ctx).Info("keeping work directory of failed render", "dir", dir)
+		return
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		logFor(ctx).Error("removing work directory", "error", err)
+	}
+}